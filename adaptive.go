@@ -0,0 +1,291 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"math"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nvanbenschoten/benchdiff/ui"
+	"golang.org/x/perf/benchstat"
+)
+
+// adaptiveAlpha is the significance level below which a benchmark's result is
+// considered decisive when sampling adaptively. It is stricter than the level
+// used in the comparison because the results are tested after every round.
+const adaptiveAlpha = 0.01
+
+// defaultAdaptiveMargin is the margin used for adaptive sampling when no
+// regression threshold is specified.
+const defaultAdaptiveMargin = 0.02
+
+// adaptiveOpts configures adaptive sampling, which stops running benchmarks
+// once their results are statistically decisive.
+type adaptiveOpts struct {
+	minCount, maxCount int
+	// budget, if non-zero, bounds the duration of the run. Once exceeded, no
+	// more rounds are started.
+	budget time.Duration
+	// margin is the relative change below which a benchmark whose samples vary
+	// by less than the margin is considered unchanged.
+	margin float64
+}
+
+// runAdaptiveBenches runs the targeted benchmarks in rounds, each of which runs
+// every undecided target once in each benchmark suite. After minCount rounds,
+// the results are compared against the baseline after every round, and
+// targets whose benchmarks are all clearly changed or clearly unchanged are no
+// longer run. Runs stop when all targets are decided, after maxCount rounds,
+// or when the time budget is exhausted.
+func runAdaptiveBenches(
+	ctx context.Context,
+	bss []*benchSuite,
+	targets []benchTarget,
+	runPattern, benchTime string,
+	po profileOpts,
+	ao adaptiveOpts,
+	rng *rand.Rand,
+	st *runState,
+) error {
+	tests := make([]string, 0, len(targets))
+	for _, t := range targets {
+		if len(tests) == 0 || tests[len(tests)-1] != t.test {
+			tests = append(tests, t.test)
+		}
+	}
+	benches, err := listCommonBenchmarks(bss, tests, runPattern)
+	if err != nil {
+		return err
+	}
+	targetBenches := func(t benchTarget) []string {
+		if t.name != "" {
+			return []string{t.name}
+		}
+		return benches[t.test]
+	}
+
+	fmt.Fprintf(os.Stderr, "\nrunning benchmarks adaptively:")
+	var spinner ui.Spinner
+	spinner.Start(os.Stderr, "")
+	defer spinner.Stop()
+	start := time.Now()
+	est := makeRunEstimator()
+	active := targets
+	rounds := 0
+	for ; rounds < ao.maxCount && len(active) > 0; rounds++ {
+		if ao.budget > 0 && time.Since(start) > ao.budget {
+			fmt.Fprintf(os.Stderr, "  time budget of %s exhausted\n", ao.budget)
+			break
+		}
+		type benchRun struct {
+			bs     *benchSuite
+			target benchTarget
+		}
+		runs := make([]benchRun, 0, len(active)*len(bss))
+		for _, t := range active {
+			for _, bs := range bss {
+				runs = append(runs, benchRun{bs: bs, target: t})
+			}
+		}
+		if rng != nil {
+			rng.Shuffle(len(runs), func(a, b int) { runs[a], runs[b] = runs[b], runs[a] })
+		}
+		for k, r := range runs {
+			// Estimate the remaining time as if all undecided targets run for the
+			// maximum number of rounds, bounded by the time budget.
+			var eta time.Duration
+			etaOK := true
+			for _, t := range active {
+				d, ok := est.estimate(t, (ao.maxCount-rounds-1)*len(bss))
+				eta, etaOK = eta+d, etaOK && ok
+			}
+			for _, r := range runs[k:] {
+				d, ok := est.estimate(r.target, 1)
+				eta, etaOK = eta+d, etaOK && ok
+			}
+			if left := ao.budget - time.Since(start); ao.budget > 0 && left < eta {
+				eta = left
+			}
+			progress := fmt.Sprintf(" round=%s run=%s undecided=%s%s %s",
+				ui.Fraction(rounds+1, ao.maxCount), ui.Fraction(k+1, len(runs)),
+				ui.Fraction(len(active), len(targets)), formatETA(eta, etaOK), r.target)
+			spinner.Update(progress)
+			if st.done(r.bs, r.target, rounds) {
+				continue
+			}
+			runStart := time.Now()
+			if err := runSingleBench(ctx, r.bs, r.target, rounds, benchTime, po); err != nil {
+				return err
+			}
+			est.record(r.target, time.Since(runStart))
+			if err := st.record(r.bs, r.target, rounds); err != nil {
+				return err
+			}
+		}
+		fmt.Fprintln(os.Stderr)
+
+		if rounds+1 < ao.minCount {
+			continue
+		}
+		decided, err := decidedBenchmarks(bss, ao.margin)
+		if err != nil {
+			return err
+		}
+		var undecided []benchTarget
+		for _, t := range active {
+			for _, b := range targetBenches(t) {
+				// Benchmarks without results yet are undecided. Output that
+				// does not name its package is keyed by the name alone.
+				d, ok := decided[benchKey{test: t.test, name: b}]
+				if !ok {
+					d = decided[benchKey{name: b}]
+				}
+				if !d {
+					undecided = append(undecided, t)
+					break
+				}
+			}
+		}
+		active = undecided
+	}
+	fmt.Fprintf(os.Stderr, "  %d of %d targets decided after %d rounds in %s\n",
+		len(targets)-len(active), len(targets), rounds, time.Since(start).Round(time.Second))
+	return nil
+}
+
+// benchKey identifies a benchmark in a test binary. Benchmarks with the same
+// name in different packages are distinct.
+type benchKey struct {
+	test string // test binary, or empty if unknown
+	name string // full name, with the Benchmark prefix
+}
+
+// decidedBenchmarks compares the results of each benchmark suite against the
+// baseline and returns, for each top-level benchmark in each package, whether
+// all of its results are decisive in every comparison.
+func decidedBenchmarks(bss []*benchSuite, margin float64) (map[benchKey]bool, error) {
+	decided := make(map[benchKey]bool)
+	for _, bs := range bss[1:] {
+		tables, err := collectBenchOutput(bss[0], bs)
+		if err != nil {
+			return nil, err
+		}
+		for _, table := range tables {
+			for _, row := range table.Rows {
+				name := benchKey{test: rowTestBin(table, row), name: topLevelName(row.Benchmark)}
+				d := rowDecided(row, margin)
+				if prev, ok := decided[name]; ok {
+					d = d && prev
+				}
+				decided[name] = d
+			}
+		}
+	}
+	return decided, nil
+}
+
+// rowDecided returns whether the comparison in the row is decisive: either the
+// difference is clearly significant or both samples and their difference are
+// within the margin.
+func rowDecided(row *benchstat.Row, margin float64) bool {
+	if len(row.Metrics) != 2 {
+		return false
+	}
+	old, new := row.Metrics[0], row.Metrics[1]
+	if p, err := benchstat.UTest(old, new); err == nil && p < adaptiveAlpha {
+		return true
+	}
+	var delta float64
+	if old.Mean != 0 {
+		delta = math.Abs(new.Mean/old.Mean - 1)
+	}
+	return delta < margin && metricsSpread(old) < margin && metricsSpread(new) < margin
+}
+
+// metricsSpread returns the largest relative deviation of a sample from the
+// mean, as reported by benchstat with ±.
+func metricsSpread(m *benchstat.Metrics) float64 {
+	if m.Mean == 0 {
+		return 0
+	}
+	return math.Max(1-m.Min/m.Mean, m.Max/m.Mean-1)
+}
+
+// topLevelName returns the name of the top-level benchmark of a benchstat
+// row, with the Benchmark prefix. Top-level benchmark names cannot contain a
+// dash, so anything after one is the GOMAXPROCS suffix.
+func topLevelName(rowName string) string {
+	top := strings.SplitN(rowName, "/", 2)[0]
+	return "Benchmark" + strings.SplitN(top, "-", 2)[0]
+}
+
+// benchProcs returns the GOMAXPROCS value that the benchmarks in the output of
+// a test binary ran with. Test binaries append it to the name of every
+// benchmark as a -N suffix, unless it is 1. Top-level benchmark names cannot
+// otherwise contain a dash, so the value is parsed from the name of any
+// top-level benchmark in the output. Failing that, it is parsed from the
+// suffix shared by the results of all sub-benchmarks.
+func benchProcs(output []byte) int {
+	var common string
+	results := 0
+	s := bufio.NewScanner(bytes.NewReader(output))
+	for s.Scan() {
+		f := strings.Fields(s.Text())
+		if len(f) == 0 || !strings.HasPrefix(f[0], "Benchmark") {
+			continue
+		}
+		if !strings.Contains(f[0], "/") {
+			return procsSuffix(f[0])
+		}
+		if len(f) < 4 {
+			// Not a result line, e.g. a benchmark that is still running.
+			continue
+		}
+		if _, err := strconv.Atoi(f[1]); err != nil {
+			continue
+		}
+		suffix := "-" + strconv.Itoa(procsSuffix(f[0]))
+		if !strings.HasSuffix(f[0], suffix) {
+			suffix = ""
+		}
+		if results == 0 {
+			common = suffix
+		} else if suffix != common {
+			common = ""
+		}
+		results++
+	}
+	if common == "" {
+		return 1
+	}
+	return procsSuffix(common)
+}
+
+// procsSuffix returns the number in the trailing -N suffix of the benchmark
+// name, or 1 if it has none.
+func procsSuffix(name string) int {
+	i := strings.LastIndexByte(name, '-')
+	if i < 0 {
+		return 1
+	}
+	n, err := strconv.Atoi(name[i+1:])
+	if err != nil || n <= 0 {
+		return 1
+	}
+	return n
+}
+
+// trimProcs returns the benchmark name without the -N suffix of the specified
+// GOMAXPROCS value, if it has one.
+func trimProcs(name string, procs int) string {
+	if procs == 1 {
+		return name
+	}
+	return strings.TrimSuffix(name, "-"+strconv.Itoa(procs))
+}
@@ -1,8 +1,14 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"go/build"
 	"hash/fnv"
+	"io"
+	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
 	"strconv"
 	"strings"
@@ -10,16 +16,227 @@ import (
 	"github.com/pkg/errors"
 )
 
+// buildConfig configures how a benchmark suite's test binaries are compiled.
+type buildConfig struct {
+	// goBin is the go toolchain binary. If empty, the go binary on the PATH is
+	// used.
+	goBin string
+	// goroot is the GOROOT of goBin, as reported by the binary itself. It is
+	// only set along with goBin.
+	goroot string
+	// flags are additional build flags passed to `go test -c` and `go list`.
+	flags []string
+	// env are additional environment variables, in KEY=VALUE form, set when
+	// running the go toolchain.
+	env []string
+}
+
+// empty returns whether the buildConfig uses the toolchain's defaults.
+func (cfg buildConfig) empty() bool {
+	return cfg.goBin == "" && len(cfg.flags) == 0 && len(cfg.env) == 0
+}
+
+// String implements fmt.Stringer.
+func (cfg buildConfig) String() string {
+	s := append(append([]string(nil), cfg.env...), cfg.flags...)
+	if cfg.goBin != "" {
+		s = append([]string{cfg.goBin}, s...)
+	}
+	return strings.Join(s, " ")
+}
+
+// goCmd returns the arguments to run the specified go subcommand with the
+// buildConfig's build flags, followed by the provided arguments.
+func (cfg buildConfig) goCmd(subcmd string, args ...string) []string {
+	cmd := append([]string{cfg.goCmdName(), subcmd}, cfg.flags...)
+	return append(cmd, args...)
+}
+
+// goCmdName returns the name of the go toolchain binary.
+func (cfg buildConfig) goCmdName() string {
+	if cfg.goBin == "" {
+		return "go"
+	}
+	return cfg.goBin
+}
+
+// captureGo runs the go toolchain with the specified arguments in the
+// specified source directory, using the buildConfig's environment.
+func (cfg buildConfig) captureGo(dir string, args ...string) (string, error) {
+	return cfg.captureGoContext(context.Background(), dir, args...)
+}
+
+// captureGoContext is like captureGo, but kills the toolchain if the context
+// is canceled before it exits.
+func (cfg buildConfig) captureGoContext(
+	ctx context.Context, dir string, args ...string,
+) (string, error) {
+	env := cfg.env
+	if cfg.goBin != "" {
+		// Make sure that the toolchain uses its own GOROOT, even if GOROOT
+		// is set in the environment, and that it does not switch to another
+		// toolchain based on the go.mod file.
+		env = append([]string{"GOROOT=" + cfg.goroot, "GOTOOLCHAIN=local"}, env...)
+	}
+	return captureInEnvContext(ctx, dir, env, args...)
+}
+
+// fileSalt returns the hashes of the files referenced by the build flags, like
+// PGO profiles, which affect the output of the build but whose contents may
+// change without the flags changing.
+func (cfg buildConfig) fileSalt() ([]string, error) {
+	var salt []string
+	for i, f := range cfg.flags {
+		var profile string
+		switch {
+		case strings.HasPrefix(f, "-pgo="), strings.HasPrefix(f, "--pgo="):
+			profile = f[strings.IndexByte(f, '=')+1:]
+		case (f == "-pgo" || f == "--pgo") && i+1 < len(cfg.flags):
+			profile = cfg.flags[i+1]
+		default:
+			continue
+		}
+		if profile == "off" || profile == "auto" {
+			continue
+		}
+		_, sum, err := hashFile(profile)
+		if err != nil {
+			return nil, errors.Wrap(err, "hashing PGO profile")
+		}
+		salt = append(salt, "pgo "+sum)
+	}
+	return salt, nil
+}
+
+// parseGoBin resolves the go toolchain specified on the command line, which
+// may either be the path to a go binary or to a GOROOT directory.
+func parseGoBin(goBin string) (string, error) {
+	if goBin == "" {
+		return "", nil
+	}
+	fi, err := os.Stat(goBin)
+	if err != nil {
+		return "", errors.Wrap(err, "looking for go toolchain")
+	}
+	if fi.IsDir() {
+		goBin = filepath.Join(goBin, "bin", "go")
+		if _, err := os.Stat(goBin); err != nil {
+			return "", errors.Wrap(err, "looking for go toolchain in GOROOT")
+		}
+	}
+	// The go binary is run in other directories, so make its path absolute.
+	// Resolve symbolic links, like /usr/local/bin/go, so that a toolchain is
+	// always named by the same path.
+	goBin, err = filepath.Abs(goBin)
+	if err != nil {
+		return "", err
+	}
+	goBin, err = filepath.EvalSymlinks(goBin)
+	return goBin, errors.Wrap(err, "resolving go toolchain")
+}
+
+// lookupGoRoot returns the GOROOT of the go binary, as reported by `go env
+// GOROOT`. The binary is not necessarily located in its GOROOT, for instance
+// if it is a golang.org/dl wrapper, so the GOROOT cannot be derived from its
+// path. GOROOT is cleared from the environment so that the binary reports
+// its own.
+func lookupGoRoot(goBin string) (string, error) {
+	goroot, err := captureInEnv("", []string{"GOROOT=", "GOTOOLCHAIN=local"}, goBin, "env", "GOROOT")
+	if err != nil {
+		return "", errors.Wrap(err, "looking up GOROOT of go toolchain")
+	}
+	if goroot == "" {
+		return "", errors.Errorf("go toolchain %s reported no GOROOT", goBin)
+	}
+	return goroot, nil
+}
+
+// parseBuildEnv validates environment variables passed through the command
+// line.
+func parseBuildEnv(env []string) ([]string, error) {
+	for _, e := range env {
+		if i := strings.IndexByte(e, '='); i <= 0 {
+			return nil, errors.Errorf("invalid environment variable %q, expected KEY=VALUE", e)
+		}
+	}
+	return env, nil
+}
+
 // expandPackages expands the package filter into all of the packages that it
-// references using `go list`.
-func expandPackages(pkgFilter []string) ([]string, error) {
-	args := []string{"go", "list"}
-	args = append(args, pkgFilter...)
-	pkgs, err := capture(args...)
+// references using `go list -e`, run in the specified source directory.
+// Packages that cannot be loaded, for instance because a package named in the
+// filter does not exist at the checked out ref, are returned as failures.
+func expandPackages(dir string, pkgFilter []string, cfg buildConfig) ([]string, buildFailures, error) {
+	args := append(cfg.goCmd("list", "-e", "-json"), pkgFilter...)
+	out, err := cfg.captureGo(dir, args...)
 	if err != nil {
-		return nil, errors.Wrap(err, "expanding packages")
+		return nil, nil, errors.Wrap(err, "expanding packages")
 	}
-	return strings.Split(pkgs, "\n"), nil
+	var pkgs []string
+	failures := make(buildFailures)
+	dec := json.NewDecoder(strings.NewReader(out))
+	for {
+		var lp struct {
+			ImportPath string
+			Error      *struct{ Err string }
+		}
+		if err := dec.Decode(&lp); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, nil, errors.Wrap(err, "decoding packages")
+		}
+		if lp.Error == nil {
+			pkgs = append(pkgs, lp.ImportPath)
+			continue
+		}
+		pkg := lp.ImportPath
+		if build.IsLocalImport(pkg) {
+			// Packages that don't exist are listed by the relative path that
+			// named them. Name them by their import path instead, like the
+			// packages of other refs.
+			if mod, err := cfg.captureGo(dir, cfg.goCmd("list", "-m")...); err == nil && !strings.Contains(mod, "\n") {
+				pkg = path.Join(mod, pkg)
+			}
+		}
+		failures[pkg] = errors.New(lp.Error.Err)
+	}
+	return pkgs, failures, nil
+}
+
+// toolchainEnvVars are the go environment variables that affect the output of
+// the go toolchain and are therefore part of each test binary's cache key.
+var toolchainEnvVars = []string{
+	"GOOS", "GOARCH", "GOAMD64", "GOARM", "GO386", "GOEXPERIMENT",
+	"GOFLAGS", "CGO_ENABLED", "CC", "CXX", "CGO_CFLAGS", "CGO_LDFLAGS",
+}
+
+// getGoVersion returns the version of the go toolchain, as reported by `go
+// version`, along with the toolchainEnvVars that it is configured with.
+func getGoVersion(cfg buildConfig) (string, error) {
+	v, err := cfg.captureGo("", cfg.goCmdName(), "version")
+	if err != nil {
+		return "", errors.Wrap(err, "getting go version")
+	}
+	env, err := cfg.captureGo("", append([]string{cfg.goCmdName(), "env"}, toolchainEnvVars...)...)
+	if err != nil {
+		return "", errors.Wrap(err, "getting go env")
+	}
+	return v + "\n" + env, nil
+}
+
+// getGoVersionName returns the short version name of the go toolchain, e.g.
+// "go1.15.2".
+func getGoVersionName(cfg buildConfig) (string, error) {
+	v, err := cfg.captureGo("", cfg.goCmdName(), "version")
+	if err != nil {
+		return "", errors.Wrap(err, "getting go version")
+	}
+	// The output is formatted as "go version <version> <os>/<arch>".
+	f := strings.Fields(v)
+	if len(f) < 3 {
+		return "", errors.Errorf("unexpected go version output %q", v)
+	}
+	return f[2], nil
 }
 
 // testDir returns the directory to store benchdiff artifacts and binaries for
@@ -34,6 +251,15 @@ func testArtifactsDir(ref string) string {
 	return filepath.Join(testDir(ref), "artifacts")
 }
 
+// testWorktreeDir returns the directory of the git worktree used to build
+// every git ref. Test binaries don't need their sources once built, so a
+// single worktree is switched between refs rather than leaving a checkout
+// behind for each. Ref names cannot start with a dot, so the directory never
+// collides with that of a ref.
+func testWorktreeDir() string {
+	return filepath.Join("benchdiff", ".worktree")
+}
+
 func hash(s []string) string {
 	h := fnv.New32a()
 	for _, ss := range s {
@@ -43,8 +269,8 @@ func hash(s []string) string {
 	return strconv.Itoa(int(u))
 }
 
-// testArtifactsDir returns the directory to store benchdiff binaries for
-// specified git ref.
+// testBinDir returns the directory to store benchdiff binaries for specified
+// git ref, when they are not cached.
 func testBinDir(ref string, pkgFilter []string) string {
 	return filepath.Join(testDir(ref), "bin", hash(pkgFilter))
 }
@@ -65,22 +291,37 @@ func testBinToPkg(bin string) string {
 	return strings.ReplaceAll(bin, "_", "/")
 }
 
-// buildTestBin builds a test binary for the specified package and moves it to
-// the destination directory if successful.
-func buildTestBin(pkg, dst string) (string, bool, error) {
+// buildTestBin builds a test binary for the specified package from the
+// specified source directory using the provided buildConfig and moves it to
+// the destination directory if successful. The binary is built into a unique
+// temporary path, so multiple test binaries can be built concurrently.
+func buildTestBin(
+	ctx context.Context, dir, pkg, dst string, cfg buildConfig,
+) (string, bool, error) {
 	f := pkgToTestBin(pkg)
+	tmp, err := ioutil.TempDir(dst, ".build-")
+	if err != nil {
+		return "", false, err
+	}
+	defer func() { _ = os.RemoveAll(tmp) }()
+	// The output path is resolved relative to the source directory, so make
+	// it absolute.
+	tmpBin, err := filepath.Abs(filepath.Join(tmp, f))
+	if err != nil {
+		return "", false, err
+	}
 	// Capture to silence warnings from pkgs with no test files.
-	if _, err := capture("go", "test", "-c", "-o", f, pkg); err != nil {
+	if _, err := cfg.captureGoContext(ctx, dir, cfg.goCmd("test", "-c", "-o", tmpBin, pkg)...); err != nil {
 		return "", false, errors.Wrap(err, "building test binary")
 	}
 	// If there were no tests in the package, no file will have been created.
-	if _, err := os.Stat(f); err != nil {
+	if _, err := os.Stat(tmpBin); err != nil {
 		if os.IsNotExist(err) {
 			return "", false, nil
 		}
 		return "", false, errors.Wrap(err, "looking for test binary")
 	}
-	if err := spawn("mv", f, dst); err != nil {
+	if err := os.Rename(tmpBin, filepath.Join(dst, f)); err != nil {
 		return "", false, errors.Wrap(err, "moving test binary")
 	}
 	return f, true, nil
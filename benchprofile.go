@@ -0,0 +1,171 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/nvanbenschoten/benchdiff/ui"
+	"github.com/pkg/errors"
+)
+
+// regressionTargets returns a target for each of the regressed benchmarks. The
+// names are those of the benchstat comparison, which retain the GOMAXPROCS
+// suffix, which is determined from the output of the baseline. Benchmarks
+// whose test binary is unknown, because the output did not name their
+// package, are targeted in every test binary that contains them.
+func regressionTargets(
+	bss []*benchSuite, tests []string, runPattern string, regressed []benchKey,
+) ([]benchTarget, error) {
+	benches, err := listCommonBenchmarks(bss, tests, runPattern)
+	if err != nil {
+		return nil, err
+	}
+	output, err := bss[0].readOutput()
+	if err != nil {
+		return nil, err
+	}
+	procs := benchProcs(output)
+	seen := make(map[benchTarget]struct{})
+	var targets []benchTarget
+	for _, key := range regressed {
+		name := trimProcs(key.name, procs)
+		pattern := benchPattern(name)
+		top := strings.SplitN(name, "/", 2)[0]
+		for _, t := range tests {
+			if key.test != "" && key.test != t {
+				continue
+			}
+			i := sort.SearchStrings(benches[t], top)
+			if i == len(benches[t]) || benches[t][i] != top {
+				continue
+			}
+			target := benchTarget{test: t, name: name, pattern: pattern}
+			if _, ok := seen[target]; !ok {
+				seen[target] = struct{}{}
+				targets = append(targets, target)
+			}
+		}
+	}
+	return targets, nil
+}
+
+// benchPattern returns a -test.bench pattern that matches exactly the
+// benchmark with the specified full name.
+func benchPattern(name string) string {
+	levels := strings.Split(name, "/")
+	for i, l := range levels {
+		levels[i] = "^" + regexp.QuoteMeta(l) + "$"
+	}
+	return strings.Join(levels, "/")
+}
+
+// profileBenchTargets runs each of the targeted benchmarks in isolation in
+// each benchmark suite, recording the specified types of profiles, and then
+// merges the profiles per package and per suite. The output of the isolated
+// runs is not part of the comparison.
+func profileBenchTargets(
+	ctx context.Context,
+	bss []*benchSuite,
+	targets []benchTarget,
+	benchTime string,
+	po profileOpts,
+) error {
+	fmt.Fprintf(os.Stderr, "\nprofiling benchmarks:")
+	var spinner ui.Spinner
+	spinner.Start(os.Stderr, "")
+	for i, target := range targets {
+		spinner.Update(fmt.Sprintf(" bench=%s %s %s",
+			ui.Fraction(i+1, len(targets)), testBinToPkg(target.test), target.name))
+		for _, bs := range bss {
+			if err := bs.profileBenchTarget(ctx, target, benchTime, po); err != nil {
+				spinner.Stop()
+				return err
+			}
+		}
+	}
+	spinner.Stop()
+	fmt.Fprintln(os.Stderr)
+
+	var tests []string
+	for _, target := range targets {
+		if len(tests) == 0 || tests[len(tests)-1] != target.test {
+			tests = append(tests, target.test)
+		}
+	}
+	return mergeBenchProfiles(bss, tests, po.types)
+}
+
+// profileBenchTarget runs the targeted benchmark in isolation, writing its
+// profiles and output to ./benchdiff/<id>/artifacts/profiles.<time>/<test>/<benchmark>.
+func (bs *benchSuite) profileBenchTarget(
+	ctx context.Context, target benchTarget, benchTime string, po profileOpts,
+) error {
+	dir := filepath.Join(bs.profDir, target.test, target.dir())
+	if err := os.MkdirAll(dir, 0744); err != nil {
+		return err
+	}
+	out, err := os.Create(filepath.Join(dir, "out"))
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	profFile := func(profType string) string {
+		return filepath.Join(dir, profType+lookupProfileType(profType).ext)
+	}
+	err = runTestBinary(ctx, bs, target.test, target.pattern, benchTime, po, profFile, out)
+	if tErr, ok := err.(*timeoutError); ok {
+		bs.recordTimeout(target, 0, tErr)
+		return nil
+	}
+	if _, ok := err.(*failureError); ok {
+		// The failure was logged, and the profiles are still written.
+		return nil
+	}
+	return err
+}
+
+// profileRegressedBenches profiles each of the regressed benchmarks in
+// isolation and outputs the differential profiles of each suite against the
+// baseline.
+func profileRegressedBenches(
+	ctx context.Context,
+	bss []*benchSuite,
+	tests []string,
+	regressed []benchKey,
+	out outputFmt,
+	runPattern, benchTime string,
+	po profileOpts,
+) error {
+	if len(regressed) == 0 {
+		return nil
+	}
+	targets, err := regressionTargets(bss, tests, runPattern, regressed)
+	if err != nil {
+		return err
+	}
+	if len(targets) == 0 {
+		return errors.New("could not find the test binaries of the regressed benchmarks")
+	}
+	if err := profileBenchTargets(ctx, bss, targets, benchTime, po); err != nil {
+		return err
+	}
+	diffs, err := diffBenchProfiles(bss, po.types)
+	if err != nil {
+		return err
+	}
+	switch out {
+	case text, sheets:
+		formatProfileDiffsText(os.Stdout, diffs)
+	case html:
+		if err := formatProfileDiffsHTML(os.Stdout, diffs); err != nil {
+			return err
+		}
+	}
+	logProfileLocations(out.logWriter(), bss, po.types)
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// runBisect searches the first-parent commits between oldRef and newRef for
+// the first commit that introduced a benchmark regression exceeding the
+// threshold. Each step of the search builds and benchmarks the midpoint of the
+// remaining range, interleaved with oldRef, and compares the two. Test
+// binaries are cached per ref, so the baseline and suites visited earlier in
+// the search are not rebuilt.
+func runBisect(
+	ctx context.Context,
+	oldRef, newRef string,
+	oldCfg, newCfg buildConfig,
+	pkgFilter []string,
+	bo buildOpts,
+	runPattern, benchTime string,
+	itersPerTest int,
+	timeout timeoutOpts,
+	retries int,
+	threshold float64,
+) error {
+	if threshold < 0 {
+		return errors.New("bisect requires --threshold")
+	}
+	if oldRef == worktreeRef || newRef == worktreeRef {
+		return errors.Errorf("cannot bisect %s", worktreeRef)
+	}
+	commits, err := getFirstParentRange(oldRef, newRef)
+	if err != nil {
+		return err
+	}
+	for i, c := range commits {
+		commits[i] = shortenRef(c)
+	}
+
+	b := bisector{
+		baseRef:      oldRef,
+		baseCfg:      oldCfg,
+		cfg:          newCfg,
+		pkgFilter:    pkgFilter,
+		bo:           bo,
+		runPattern:   runPattern,
+		benchTime:    benchTime,
+		itersPerTest: itersPerTest,
+		timeout:      timeout,
+		retries:      retries,
+		threshold:    threshold,
+	}
+
+	// Confirm that the new ref regressed in the first place. Commits are
+	// indexed such that -1 refers to oldRef, which is known to be good.
+	good, bad := -1, len(commits)-1
+	fmt.Fprintf(os.Stderr, "bisecting %d commits between '%s' and '%s'\n", len(commits), oldRef, newRef)
+	if regressed, err := b.step(ctx, commits[bad]); err != nil {
+		return err
+	} else if !regressed {
+		fmt.Printf("no regression exceeding threshold of %.2f%% between '%s' and '%s'\n",
+			threshold*100, oldRef, newRef)
+		return nil
+	}
+
+	for bad-good > 1 {
+		mid := good + (bad-good)/2
+		fmt.Fprintf(os.Stderr, "\nbisecting: %d commits left to test (roughly %d steps)\n",
+			bad-good-1, bisectSteps(bad-good-1))
+		regressed, err := b.step(ctx, commits[mid])
+		if err != nil {
+			return err
+		}
+		if regressed {
+			bad = mid
+		} else {
+			good = mid
+		}
+	}
+
+	desc, err := describeRef(commits[bad])
+	if err != nil {
+		return err
+	}
+	fmt.Printf("first regressing commit: %s\n", desc)
+	return nil
+}
+
+// bisector holds the configuration shared by the steps of a bisection.
+type bisector struct {
+	baseRef      string
+	baseCfg      buildConfig
+	cfg          buildConfig // of the bisected commits
+	pkgFilter    []string
+	bo           buildOpts
+	runPattern   string
+	benchTime    string
+	itersPerTest int
+	timeout      timeoutOpts
+	retries      int
+	threshold    float64
+}
+
+// makeSuite returns a benchmark suite for the ref, with the timeouts and
+// retries of the bisection.
+func (b *bisector) makeSuite(ref, label string, cfg buildConfig) benchSuite {
+	bs := makeBenchSuite(ref, label, cfg)
+	bs.timeout = b.timeout
+	bs.retries = b.retries
+	return bs
+}
+
+// step benchmarks the specified ref against the baseline and reports whether
+// any benchmark regressed by more than the threshold. The baseline is
+// benchmarked again in every step, interleaved with the ref, so that both are
+// measured under the same conditions.
+func (b *bisector) step(ctx context.Context, ref string) (bool, error) {
+	oldSuite := b.makeSuite(b.baseRef, "old", b.baseCfg)
+	newSuite := b.makeSuite(ref, "new", b.cfg)
+	defer oldSuite.close()
+	defer newSuite.close()
+	suites := []*benchSuite{&oldSuite, &newSuite}
+
+	if err := buildBenches(ctx, b.pkgFilter, b.bo, time.Now(), suites...); err != nil {
+		return false, err
+	}
+	tests := intersectTests(suites)
+	targets := pkgTargets(tests.sorted(), b.runPattern)
+	if err := runCmpBenches(
+		ctx, suites, targets, b.benchTime, profileOpts{}, b.itersPerTest, nil, 0, nil,
+	); err != nil {
+		return false, err
+	}
+	res, err := collectBenchOutput(suites...)
+	if err != nil {
+		return false, err
+	}
+	if err := checkPassing(b.threshold, res); err != nil {
+		fmt.Fprintf(os.Stderr, "'%s' is bad: %s\n", ref, err)
+		return true, nil
+	}
+	fmt.Fprintf(os.Stderr, "'%s' is good\n", ref)
+	return false, nil
+}
+
+// bisectSteps returns the number of steps required to bisect n commits.
+func bisectSteps(n int) int {
+	steps := 0
+	for n > 0 {
+		n /= 2
+		steps++
+	}
+	return steps
+}
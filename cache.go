@@ -0,0 +1,391 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// The test binary cache is content-addressed. Each package's test binary is
+// stored under a key derived from the contents of the package and all of its
+// (test) dependencies at the ref it was built from, along with the toolchain
+// and build configuration that it was built with. This allows test binaries to
+// be shared across refs with identical trees and across overlapping package
+// filters.
+//
+// The layout of the cache is:
+//
+//   ./benchdiff/cache/<key>/manifest.json
+//   ./benchdiff/cache/<key>/<test binary>
+//
+// An entry is only installed into the cache once it has been fully built, and
+// the size and modification time of its test binary are validated against its
+// manifest before being used. Only refs whose checkout is clean are cached, as
+// the keys are derived from the ref's tree rather than from the checkout.
+
+// cacheVersion is mixed into each cache key. Bump it when changing the way that
+// keys are computed or entries are laid out.
+const cacheVersion = "benchdiff cache v2"
+
+// cacheManifest describes a single entry in the test binary cache.
+type cacheManifest struct {
+	Key     string    `json:"key"`
+	Pkg     string    `json:"pkg"`
+	Ref     string    `json:"ref"`      // ref the entry was built from
+	TestBin string    `json:"test_bin"` // empty if no test binary was produced
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	SHA256  string    `json:"sha256"`
+	Created time.Time `json:"created"`
+}
+
+// cacheIndex maps each package in an expanded package filter to the cache key
+// of its test binary. It is stored per ref so that a fully cached ref does not
+// need to be checked out to determine its cache keys.
+type cacheIndex struct {
+	Keys map[string]string `json:"keys"`
+}
+
+// cacheDir returns the directory of the test binary cache, which is shared
+// across all git refs.
+func cacheDir() string {
+	return filepath.Join("benchdiff", "cache")
+}
+
+// cacheEntryDir returns the directory of the cache entry with the given key.
+func cacheEntryDir(key string) string {
+	return filepath.Join(cacheDir(), key)
+}
+
+// testBinIndexFile returns the file that stores the cache index for the
+// specified git ref, package filter, and build configuration.
+func testBinIndexFile(ref string, pkgFilter []string, buildSalt []string) string {
+	s := append(append([]string(nil), pkgFilter...), buildSalt...)
+	return filepath.Join(testDir(ref), "bin", hash(s)+".json")
+}
+
+// readCacheIndex reads the cache index from the specified file. It returns
+// false if the index does not exist or cannot be decoded.
+func readCacheIndex(file string) (cacheIndex, bool) {
+	var idx cacheIndex
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return idx, false
+	}
+	if err := json.Unmarshal(b, &idx); err != nil {
+		return idx, false
+	}
+	return idx, true
+}
+
+// writeCacheIndex atomically writes the cache index to the specified file.
+func writeCacheIndex(file string, idx cacheIndex) error {
+	b, err := json.MarshalIndent(idx, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, b)
+}
+
+// lookupCacheEntry returns the manifest of the cache entry with the given key,
+// if one exists and is valid. Invalid entries, like those left behind by a
+// corrupted cache directory, are removed.
+func lookupCacheEntry(key string) (cacheManifest, bool) {
+	dir := cacheEntryDir(key)
+	m, err := validateCacheEntry(dir, key)
+	if err != nil {
+		if !os.IsNotExist(errors.Cause(err)) {
+			fmt.Fprintf(os.Stderr, "removing invalid cache entry %s: %v\n", dir, err)
+			_ = os.RemoveAll(dir)
+		}
+		return cacheManifest{}, false
+	}
+	return m, true
+}
+
+// validateCacheEntry reads the manifest of the cache entry in the specified
+// directory and verifies that the entry's test binary matches it. The test
+// binary is not re-hashed, which would be slow for large binaries; the SHA-256
+// in the manifest is only informational.
+func validateCacheEntry(dir, key string) (cacheManifest, error) {
+	var m cacheManifest
+	b, err := ioutil.ReadFile(filepath.Join(dir, "manifest.json"))
+	if err != nil {
+		return m, errors.Wrap(err, "reading manifest")
+	}
+	if err := json.Unmarshal(b, &m); err != nil {
+		return m, errors.Wrap(err, "decoding manifest")
+	}
+	if m.Key != key {
+		return m, errors.Errorf("manifest key %s does not match", m.Key)
+	}
+	if m.TestBin == "" {
+		return m, nil
+	}
+	fi, err := os.Stat(filepath.Join(dir, m.TestBin))
+	if err != nil {
+		return m, errors.Wrap(err, "reading test binary")
+	}
+	if fi.Size() != m.Size || !fi.ModTime().Equal(m.ModTime) {
+		return m, errors.Errorf("test binary %s does not match manifest", m.TestBin)
+	}
+	return m, nil
+}
+
+// buildCacheEntry builds the test binary for the specified package from the
+// specified source directory using the provided buildConfig and installs it
+// into the cache under the given key.
+func buildCacheEntry(
+	ctx context.Context, dir, pkg, ref, key string, cfg buildConfig,
+) (cacheManifest, error) {
+	if err := os.MkdirAll(cacheDir(), 0755); err != nil {
+		return cacheManifest{}, err
+	}
+	// Build into a temporary directory so that a partial build is never
+	// mistaken for a cache entry.
+	tmp, err := ioutil.TempDir(cacheDir(), "tmp-")
+	if err != nil {
+		return cacheManifest{}, err
+	}
+	defer func() { _ = os.RemoveAll(tmp) }()
+
+	m := cacheManifest{Key: key, Pkg: pkg, Ref: ref, Created: time.Now().UTC()}
+	testBin, ok, err := buildTestBin(ctx, dir, pkg, tmp, cfg)
+	if err != nil {
+		return cacheManifest{}, err
+	}
+	if ok {
+		m.TestBin = testBin
+		if m.Size, m.SHA256, err = hashFile(filepath.Join(tmp, testBin)); err != nil {
+			return cacheManifest{}, err
+		}
+		// Renaming the entry into place preserves the modification time.
+		fi, err := os.Stat(filepath.Join(tmp, testBin))
+		if err != nil {
+			return cacheManifest{}, err
+		}
+		m.ModTime = fi.ModTime().UTC()
+	}
+	b, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return cacheManifest{}, err
+	}
+	if err := ioutil.WriteFile(filepath.Join(tmp, "manifest.json"), b, 0644); err != nil {
+		return cacheManifest{}, err
+	}
+	if err := os.Rename(tmp, cacheEntryDir(key)); err != nil {
+		// Another process may have installed the same entry concurrently.
+		if existing, ok := lookupCacheEntry(key); ok {
+			return existing, nil
+		}
+		return cacheManifest{}, errors.Wrap(err, "installing cache entry")
+	}
+	return m, nil
+}
+
+// testBinPath returns the path of the test binary in the cache entry, or false
+// if the entry's package had no tests.
+func (m cacheManifest) testBinPath() (string, bool) {
+	if m.TestBin == "" {
+		return "", false
+	}
+	return filepath.Join(cacheEntryDir(m.Key), m.TestBin), true
+}
+
+// listedPkg is the subset of `go list -json` output used to compute cache
+// keys. The embed fields are only set by go1.16 and later.
+type listedPkg struct {
+	ImportPath      string
+	Dir             string
+	Standard        bool
+	Deps            []string
+	EmbedFiles      []string
+	TestEmbedFiles  []string
+	XTestEmbedFiles []string
+}
+
+// computeCacheKeys computes the cache key of the test binary for each of the
+// specified packages, as built from the source directory checked out at the
+// specified ref. Packages without test files are omitted from the result.
+//
+// Each key covers the git blobs of the files in the directory of the package
+// and of each of its non-standard dependencies, including test-only
+// dependencies, along with the module files at the root of the repository.
+// Files embedded with //go:embed may live in subdirectories, so their contents
+// are hashed individually.
+// Dependencies outside of the repository (e.g. in the module cache) are
+// identified by their directory, which includes their module version. The
+// standard library and all other build inputs are expected to be identified by
+// the buildSalt, which must include the buildConfig.
+func computeCacheKeys(
+	dir, ref string, pkgs []string, cfg buildConfig, buildSalt []string,
+) (map[string]string, error) {
+	listed, err := listTestDeps(dir, pkgs, cfg)
+	if err != nil {
+		return nil, err
+	}
+	blobs, err := listTreeBlobs(ref)
+	if err != nil {
+		return nil, err
+	}
+	top, err := captureIn(dir, "git", "rev-parse", "--show-toplevel")
+	if err != nil {
+		return nil, errors.Wrap(err, "finding repository root")
+	}
+	top = evalSymlinks(top)
+
+	// Group blobs by directory for quick lookup.
+	dirBlobs := make(map[string][]string)
+	for _, b := range blobs {
+		d := path.Dir(b.path)
+		dirBlobs[d] = append(dirBlobs[d], b.path+" "+b.sha)
+	}
+	rootFiles := make(map[string]string)
+	for _, b := range blobs {
+		switch b.path {
+		case "go.mod", "go.sum", "vendor/modules.txt":
+			rootFiles[b.path] = b.sha
+		}
+	}
+
+	keys := make(map[string]string, len(pkgs))
+	for _, pkg := range pkgs {
+		testMain, ok := listed[pkg+".test"]
+		if !ok {
+			// No test files.
+			continue
+		}
+
+		h := sha256.New()
+		line := func(format string, args ...interface{}) {
+			fmt.Fprintf(h, format+"\n", args...)
+		}
+		line(cacheVersion)
+		for _, s := range buildSalt {
+			line("salt %s", s)
+		}
+		line("pkg %s", pkg)
+		for _, f := range []string{"go.mod", "go.sum", "vendor/modules.txt"} {
+			line("root %s %s", f, rootFiles[f])
+		}
+		deps := append([]string{pkg + ".test"}, testMain.Deps...)
+		sort.Strings(deps)
+		for _, dep := range deps {
+			lp, ok := listed[dep]
+			if !ok {
+				return nil, errors.Errorf("missing dependency %q of %q", dep, pkg)
+			}
+			if lp.Standard {
+				line("dep %s std", dep)
+				continue
+			}
+			rel, err := filepath.Rel(top, evalSymlinks(lp.Dir))
+			if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+				line("dep %s ext %s", dep, lp.Dir)
+				continue
+			}
+			line("dep %s tree %s", dep, filepath.ToSlash(rel))
+			for _, b := range dirBlobs[filepath.ToSlash(rel)] {
+				line("  %s", b)
+			}
+			for _, f := range lp.embedFiles() {
+				_, sum, err := hashFile(filepath.Join(lp.Dir, f))
+				if err != nil {
+					return nil, errors.Wrapf(err, "hashing embedded file of %q", dep)
+				}
+				line("  embed %s %s", f, sum)
+			}
+		}
+		keys[pkg] = hex.EncodeToString(h.Sum(nil))
+	}
+	return keys, nil
+}
+
+// listTestDeps lists the specified packages, their test binaries, and all of
+// their dependencies using `go list`, run in the specified source directory.
+func listTestDeps(dir string, pkgs []string, cfg buildConfig) (map[string]listedPkg, error) {
+	args := cfg.goCmd("list", "-e", "-deps", "-test", "-json")
+	args = append(args, pkgs...)
+	out, err := cfg.captureGo(dir, args...)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing test dependencies")
+	}
+	listed := make(map[string]listedPkg)
+	dec := json.NewDecoder(strings.NewReader(out))
+	for {
+		var lp listedPkg
+		if err := dec.Decode(&lp); err == io.EOF {
+			break
+		} else if err != nil {
+			return nil, errors.Wrap(err, "decoding test dependencies")
+		}
+		listed[lp.ImportPath] = lp
+	}
+	return listed, nil
+}
+
+// embedFiles returns the files embedded in the package or its tests, relative
+// to the package's directory, sorted and without duplicates.
+func (lp listedPkg) embedFiles() []string {
+	seen := make(map[string]struct{})
+	var files []string
+	for _, fs := range [][]string{lp.EmbedFiles, lp.TestEmbedFiles, lp.XTestEmbedFiles} {
+		for _, f := range fs {
+			if _, ok := seen[f]; !ok {
+				seen[f] = struct{}{}
+				files = append(files, f)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// writeFileAtomic writes the data to the specified file by first writing it
+// to a temporary file and then renaming it into place.
+func writeFileAtomic(file string, b []byte) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	tmp := file + ".tmp"
+	if err := ioutil.WriteFile(tmp, b, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, file)
+}
+
+// hashFile returns the size and hex-encoded SHA-256 of the specified file.
+func hashFile(file string) (int64, string, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return 0, "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	n, err := io.Copy(h, f)
+	if err != nil {
+		return 0, "", err
+	}
+	return n, hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// evalSymlinks returns the path with any symbolic links resolved. If they
+// cannot be resolved, the path is returned unchanged.
+func evalSymlinks(p string) string {
+	if r, err := filepath.EvalSymlinks(p); err == nil {
+		return r
+	}
+	return p
+}
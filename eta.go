@@ -0,0 +1,71 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"time"
+)
+
+// runEstimator tracks the duration of benchmark runs to estimate the time
+// remaining in a run.
+type runEstimator struct {
+	byTarget map[benchTarget]runDurations
+	all      runDurations
+}
+
+// runDurations is the total duration of a number of runs.
+type runDurations struct {
+	total time.Duration
+	n     int
+}
+
+func (d runDurations) mean() time.Duration {
+	return d.total / time.Duration(d.n)
+}
+
+func makeRunEstimator() runEstimator {
+	return runEstimator{byTarget: make(map[benchTarget]runDurations)}
+}
+
+// record records the duration of a single run of the target in one suite.
+func (e *runEstimator) record(t benchTarget, d time.Duration) {
+	td := e.byTarget[t]
+	td.total += d
+	td.n++
+	e.byTarget[t] = td
+	e.all.total += d
+	e.all.n++
+}
+
+// estimate returns the expected duration of the specified number of runs of
+// the target. Targets that have not run yet are expected to take as long as
+// the average run. It returns false if nothing has run yet.
+func (e *runEstimator) estimate(t benchTarget, runs int) (time.Duration, bool) {
+	if e.all.n == 0 {
+		return 0, false
+	}
+	mean := e.all.mean()
+	if td, ok := e.byTarget[t]; ok {
+		mean = td.mean()
+	}
+	return mean * time.Duration(runs), true
+}
+
+// formatETA formats the estimated remaining time for a progress line.
+func formatETA(d time.Duration, ok bool) string {
+	if !ok {
+		return ""
+	}
+	return fmt.Sprintf(" eta=%s", d.Round(time.Second))
+}
+
+// maxDurationExceeded returns whether a run that started at the specified
+// time has run for longer than maxDuration, if non-zero. If it has, it logs
+// that the run is stopping early.
+func maxDurationExceeded(start time.Time, maxDuration time.Duration) bool {
+	if maxDuration == 0 || time.Since(start) < maxDuration {
+		return false
+	}
+	fmt.Fprintf(os.Stderr, "  maximum duration of %s reached; stopping early\n", maxDuration)
+	return true
+}
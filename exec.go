@@ -2,9 +2,12 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"io"
 	"os"
 	"os/exec"
+	"strings"
+	"unicode"
 
 	"github.com/pkg/errors"
 )
@@ -13,13 +16,29 @@ import (
 // the process exits with a failing exit code, capture instead returns an error
 // which includes the process's stderr.
 func capture(args ...string) (string, error) {
-	var cmd *exec.Cmd
-	if len(args) == 0 {
-		panic("capture called with no arguments")
-	} else if len(args) == 1 {
-		cmd = exec.Command(args[0])
-	} else {
-		cmd = exec.Command(args[0], args[1:]...)
+	return captureIn("", args...)
+}
+
+// captureIn is like capture, but executes the command in the specified
+// directory. An empty directory refers to the current working directory.
+func captureIn(dir string, args ...string) (string, error) {
+	return captureInEnv(dir, nil, args...)
+}
+
+// captureInEnv is like captureIn, but adds the provided environment variables,
+// in KEY=VALUE form, to the command's environment.
+func captureInEnv(dir string, env []string, args ...string) (string, error) {
+	return captureInEnvContext(context.Background(), dir, env, args...)
+}
+
+// captureInEnvContext is like captureInEnv, but kills the process if the
+// context is canceled before it exits.
+func captureInEnvContext(
+	ctx context.Context, dir string, env []string, args ...string,
+) (string, error) {
+	cmd := commandContext(ctx, dir, args...)
+	if len(env) > 0 {
+		cmd.Env = append(os.Environ(), env...)
 	}
 	out, err := cmd.Output()
 	if err != nil {
@@ -46,16 +65,82 @@ func spawn(args ...string) error {
 // code, run returns a generic "process exited with status..." error, as the
 // process has likely written an error message to stderr.
 func spawnWith(in io.Reader, out, err io.Writer, args ...string) error {
+	return spawnWithIn("", in, out, err, args...)
+}
+
+// spawnWithIn is like spawnWith, but executes the command in the specified
+// directory. An empty directory refers to the current working directory.
+func spawnWithIn(dir string, in io.Reader, out, err io.Writer, args ...string) error {
+	return spawnWithContext(context.Background(), dir, in, out, err, args...)
+}
+
+// spawnWithContext is like spawnWithIn, but kills the process if the context
+// is canceled before it exits.
+func spawnWithContext(
+	ctx context.Context, dir string, in io.Reader, out, err io.Writer, args ...string,
+) error {
+	cmd := commandContext(ctx, dir, args...)
+	cmd.Stdin = in
+	cmd.Stdout = out
+	cmd.Stderr = err
+	return cmd.Run()
+}
+
+// command constructs an *exec.Cmd for the command specified by args, to be
+// executed in the specified directory.
+func command(dir string, args ...string) *exec.Cmd {
+	return commandContext(context.Background(), dir, args...)
+}
+
+// commandContext is like command, but the process is killed if the context is
+// canceled before it exits.
+func commandContext(ctx context.Context, dir string, args ...string) *exec.Cmd {
 	var cmd *exec.Cmd
 	if len(args) == 0 {
-		panic("spawn called with no arguments")
+		panic("command called with no arguments")
 	} else if len(args) == 1 {
-		cmd = exec.Command(args[0])
+		cmd = exec.CommandContext(ctx, args[0])
 	} else {
-		cmd = exec.Command(args[0], args[1:]...)
+		cmd = exec.CommandContext(ctx, args[0], args[1:]...)
 	}
-	cmd.Stdin = in
-	cmd.Stdout = out
-	cmd.Stderr = err
-	return cmd.Run()
+	cmd.Dir = dir
+	return cmd
+}
+
+// splitArgs splits a command line into arguments on whitespace. Single and
+// double quotes can be used to group arguments that contain whitespace.
+func splitArgs(s string) ([]string, error) {
+	var args []string
+	var cur strings.Builder
+	var quote rune
+	inArg := false
+	for _, r := range s {
+		switch {
+		case quote != 0:
+			if r == quote {
+				quote = 0
+			} else {
+				cur.WriteRune(r)
+			}
+		case r == '\'' || r == '"':
+			quote = r
+			inArg = true
+		case unicode.IsSpace(r):
+			if inArg {
+				args = append(args, cur.String())
+				cur.Reset()
+				inArg = false
+			}
+		default:
+			cur.WriteRune(r)
+			inArg = true
+		}
+	}
+	if quote != 0 {
+		return nil, errors.Errorf("unterminated quote in %q", s)
+	}
+	if inArg {
+		args = append(args, cur.String())
+	}
+	return args, nil
 }
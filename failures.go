@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// benchFailure records a benchmark that failed in a run of a test binary.
+type benchFailure struct {
+	Test string `json:"test"`
+	// Benchmark is the full name of the benchmark, without the GOMAXPROCS
+	// suffix.
+	Benchmark string `json:"benchmark"`
+	Iter      int    `json:"iter"`
+	Attempts  int    `json:"attempts"`
+	// Output is the failure output of the last attempt.
+	Output string `json:"output,omitempty"`
+}
+
+// failureError is returned by runTestBinary when one or more benchmarks
+// failed.
+type failureError struct {
+	failures []benchFailure // only Benchmark and Output are set
+}
+
+func (e *failureError) Error() string {
+	names := make([]string, len(e.failures))
+	for i, f := range e.failures {
+		names[i] = f.Benchmark
+	}
+	return "failed: " + strings.Join(names, ", ")
+}
+
+// failureMarker precedes the name of a failed benchmark in the output of a
+// test binary. It may follow the name of the benchmark on the same line, if
+// the benchmark failed before reporting a result.
+const failureMarker = "--- FAIL: "
+
+// parseBenchFailures returns the benchmarks that failed in the output of a
+// test binary, along with their indented failure output. Benchmarks that only
+// failed because one of their sub-benchmarks failed are omitted.
+func parseBenchFailures(output []byte) []benchFailure {
+	var failures []benchFailure
+	var cur *benchFailure
+	s := bufio.NewScanner(bytes.NewReader(output))
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.Index(line, failureMarker); i >= 0 {
+			f := strings.Fields(line[i+len(failureMarker):])
+			if len(f) == 0 {
+				cur = nil
+				continue
+			}
+			// Failures are reported without the GOMAXPROCS suffix.
+			failures = append(failures, benchFailure{Benchmark: f[0]})
+			cur = &failures[len(failures)-1]
+			continue
+		}
+		if cur != nil && strings.HasPrefix(line, " ") {
+			cur.Output += strings.TrimPrefix(line, "    ") + "\n"
+			continue
+		}
+		cur = nil
+	}
+
+	// Drop the parents of failed sub-benchmarks, which would otherwise be
+	// retried as a whole.
+	res := failures[:0]
+	for _, f := range failures {
+		parent := false
+		for _, g := range failures {
+			if strings.HasPrefix(g.Benchmark, f.Benchmark+"/") {
+				parent = true
+				break
+			}
+		}
+		if !parent || f.Output != "" {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+// retryFailures retries each of the benchmarks that failed in the iter'th run
+// of the target, up to the suite's number of retries. Retries are not
+// profiled, and their output is written to the suite's output file like that
+// of any other run. Benchmarks that fail on every attempt are quarantined,
+// which excludes them from the comparison.
+func (bs *benchSuite) retryFailures(
+	ctx context.Context, target benchTarget, iter int, benchTime string, failures []benchFailure,
+) error {
+	noProfile := func(string) string { return "" }
+	for _, f := range failures {
+		f.Test, f.Iter, f.Attempts = target.test, iter, 1
+		if bs.isQuarantined(f.Test, f.Benchmark) {
+			// Don't retry benchmarks that are already excluded.
+			continue
+		}
+		passed := false
+		for !passed && f.Attempts <= bs.retries {
+			fmt.Fprintf(os.Stderr, "  retrying %s (%d/%d)\n", f.Benchmark, f.Attempts, bs.retries)
+			f.Attempts++
+			err := runTestBinary(
+				ctx, bs, target.test, benchPattern(f.Benchmark), benchTime, profileOpts{}, noProfile, bs.outFile,
+			)
+			if fErr, ok := err.(*failureError); ok {
+				for _, g := range fErr.failures {
+					if g.Benchmark == f.Benchmark {
+						f.Output = g.Output
+					}
+				}
+				continue
+			} else if err != nil {
+				return err
+			}
+			passed = true
+		}
+		if !passed {
+			fmt.Fprintf(os.Stderr, "  %s failed %d time(s); excluding it from the comparison\n",
+				f.Benchmark, f.Attempts)
+			bs.quarantined = append(bs.quarantined, f)
+		}
+	}
+	return nil
+}
+
+// isQuarantined returns whether the benchmark with the specified full name in
+// the test binary is quarantined in the suite.
+func (bs *benchSuite) isQuarantined(test, name string) bool {
+	for _, f := range bs.quarantined {
+		if f.Test == test && f.Benchmark == name {
+			return true
+		}
+	}
+	return false
+}
+
+// filterQuarantined removes the results of the quarantined benchmarks from
+// benchmark output. Results are attributed to the package named by the last
+// "pkg:" line before them, which test binaries print before their results.
+func filterQuarantined(data []byte, quarantined map[benchKey]struct{}) []byte {
+	if len(quarantined) == 0 {
+		return data
+	}
+	procs := benchProcs(data)
+	var test string
+	var buf bytes.Buffer
+	s := bufio.NewScanner(bytes.NewReader(data))
+	for s.Scan() {
+		line := s.Bytes()
+		if f := strings.Fields(string(line)); len(f) == 2 && f[0] == "pkg:" {
+			test = pkgToTestBin(f[1])
+		} else if len(f) > 0 && strings.HasPrefix(f[0], "Benchmark") {
+			if _, ok := quarantined[benchKey{test: test, name: trimProcs(f[0], procs)}]; ok {
+				continue
+			}
+		}
+		buf.Write(line)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// logQuarantined logs the benchmarks that each suite excluded from the
+// comparison because they failed persistently, along with their failure
+// output.
+func logQuarantined(bss []*benchSuite) {
+	var n int
+	for _, bs := range bss {
+		n += len(bs.quarantined)
+	}
+	if n == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\nexcluded %d benchmark(s) that failed persistently:\n", n)
+	for _, bs := range bss {
+		if len(bs.quarantined) == 0 {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "  %s ('%s'):\n", bs.label, bs.ref)
+		for _, f := range bs.quarantined {
+			fmt.Fprintf(os.Stderr, "    %s %s iter=%d, failed %d time(s):\n",
+				testBinToPkg(f.Test), f.Benchmark, f.Iter+1, f.Attempts)
+			out := strings.TrimRight(f.Output, "\n")
+			if out == "" {
+				out = "(no output)"
+			}
+			fmt.Fprintf(os.Stderr, "      %s\n", strings.ReplaceAll(out, "\n", "\n      "))
+		}
+	}
+}
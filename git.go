@@ -2,6 +2,7 @@ package main
 
 import (
 	"os"
+	"path/filepath"
 	"strconv"
 	"strings"
 
@@ -87,11 +88,149 @@ func checkoutRef(ref string, postCheckout string) error {
 	if err := spawn("git", "checkout", "-q", ref); err != nil {
 		return errors.Wrap(err, "checkout ref")
 	}
+	return runPostCheckout("", postCheckout)
+}
+
+// checkoutWorktree prepares a git worktree at the specified directory that is
+// checked out to the specified ref, without touching the current working
+// directory's checkout. If a worktree already exists at the directory, it is
+// reused and switched to the ref, discarding any changes made to it, for
+// instance by the post-checkout command of another ref. If a post-checkout
+// command is provided, it is run in the worktree after checking out the ref.
+func checkoutWorktree(dir, ref string, postCheckout string) error {
+	if ok, err := isWorktree(dir); err != nil {
+		return err
+	} else if ok {
+		if err := spawnWithIn(dir, os.Stdin, os.Stderr, os.Stderr,
+			"git", "checkout", "-q", "--force", "--detach", ref); err != nil {
+			return errors.Wrap(err, "checkout worktree ref")
+		}
+	} else {
+		// The directory is not a usable worktree. It may be left over from an
+		// interrupted run, so clear it out and prune any stale worktree
+		// metadata before recreating it. Pruning only removes the metadata of
+		// worktrees whose directories no longer exist.
+		if err := os.RemoveAll(dir); err != nil {
+			return errors.Wrap(err, "removing stale worktree")
+		}
+		if err := spawnWith(os.Stdin, os.Stderr, os.Stderr, "git", "worktree", "prune"); err != nil {
+			return errors.Wrap(err, "pruning worktrees")
+		}
+		if err := spawnWith(os.Stdin, os.Stderr, os.Stderr,
+			"git", "worktree", "add", "-q", "--detach", dir, ref); err != nil {
+			return errors.Wrap(err, "adding worktree")
+		}
+	}
+	return runPostCheckout(dir, postCheckout)
+}
+
+// isWorktree determines whether the specified directory is the root of a git
+// worktree.
+func isWorktree(dir string) (bool, error) {
+	if _, err := os.Stat(dir); err != nil {
+		if os.IsNotExist(err) {
+			return false, nil
+		}
+		return false, errors.Wrap(err, "looking for worktree")
+	}
+	top, err := captureIn(dir, "git", "rev-parse", "--show-toplevel")
+	if err != nil {
+		// Not a git directory, or a corrupt worktree.
+		return false, nil
+	}
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		return false, err
+	}
+	// Resolve symlinks on both sides, as git reports the physical path.
+	return evalSymlinks(top) == evalSymlinks(absDir), nil
+}
+
+// isCleanCheckout determines whether the checkout in the specified directory
+// has no uncommitted changes or untracked files, ignoring benchdiff's own
+// directory. An empty directory refers to the current working directory.
+func isCleanCheckout(dir string) (bool, error) {
+	out, err := captureIn(dir, "git", "status", "--porcelain", "--", ".", ":(exclude)benchdiff")
+	if err != nil {
+		return false, errors.Wrap(err, "checking for uncommitted changes")
+	}
+	return out == "", nil
+}
+
+// runPostCheckout runs the post-checkout command, if one is provided, in the
+// specified directory.
+func runPostCheckout(dir string, postCheckout string) error {
 	if postCheckout == "" {
 		return nil
 	}
 	args := strings.Split(postCheckout, " ")
 	// Send all output of post-checkout hook to stderr.
-	err := spawnWith(os.Stdin, os.Stderr, os.Stderr, args...)
+	err := spawnWithIn(dir, os.Stdin, os.Stderr, os.Stderr, args...)
 	return errors.Wrap(err, "post-checkout")
 }
+
+// getRefRange returns the SHAs of the commits that are reachable from the "to"
+// ref but not from the "from" ref, oldest first.
+func getRefRange(from, to string) ([]string, error) {
+	out, err := capture("git", "rev-list", "--reverse", from+".."+to)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing git ref range")
+	}
+	if out == "" {
+		return nil, errors.Errorf("empty git ref range %s..%s", from, to)
+	}
+	return strings.Split(out, "\n"), nil
+}
+
+// getFirstParentRange returns the SHAs of the commits on the first-parent
+// chain from the "from" ref to the "to" ref, oldest first. Unlike
+// getRefRange, commits on side branches merged into the chain are omitted, so
+// that the range is linear and can be bisected.
+func getFirstParentRange(from, to string) ([]string, error) {
+	out, err := capture("git", "rev-list", "--reverse", "--first-parent", "--ancestry-path", from+".."+to)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing git ref range")
+	}
+	if out == "" {
+		return nil, errors.Errorf("no first-parent path from '%s' to '%s'", from, to)
+	}
+	return strings.Split(out, "\n"), nil
+}
+
+// describeRef returns a one-line description of the specified git ref,
+// including its abbreviated SHA and subject.
+func describeRef(ref string) (string, error) {
+	desc, err := capture("git", "log", "-1", "--format=%h %s", ref)
+	if err != nil {
+		return "", errors.Wrap(err, "describing git ref")
+	}
+	return desc, nil
+}
+
+// treeBlob is a file in a git tree.
+type treeBlob struct {
+	path string // relative to the root of the tree, slash-separated
+	sha  string
+}
+
+// listTreeBlobs returns all files in the tree of the specified git ref.
+func listTreeBlobs(ref string) ([]treeBlob, error) {
+	out, err := capture("git", "ls-tree", "-r", "-z", "--full-tree", ref)
+	if err != nil {
+		return nil, errors.Wrap(err, "listing git tree")
+	}
+	var blobs []treeBlob
+	for _, e := range strings.Split(out, "\x00") {
+		// Each entry is formatted as "<mode> SP <type> SP <object> TAB <file>".
+		tab := strings.IndexByte(e, '\t')
+		if tab < 0 {
+			continue
+		}
+		meta := strings.Fields(e[:tab])
+		if len(meta) != 3 {
+			continue
+		}
+		blobs = append(blobs, treeBlob{path: e[tab+1:], sha: meta[2]})
+	}
+	return blobs, nil
+}
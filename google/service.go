@@ -81,9 +81,12 @@ func (srv *Service) CreateSheet(
 		sheetInfos[i] = info
 	}
 
-	// Pivot table overview sheet. Place in front.
-	overview := srv.createOverviewSheet(sheetInfos)
-	s.Sheets = append([]*sheets.Sheet{overview}, s.Sheets...)
+	// Pivot table overview sheet. Place in front. Tables comparing more than
+	// two configurations have no deltas, so there is nothing to summarize.
+	if len(tables) > 0 && tables[0].OldNewDelta {
+		overview := srv.createOverviewSheet(sheetInfos)
+		s.Sheets = append([]*sheets.Sheet{overview}, s.Sheets...)
+	}
 
 	// Create the spreadsheet.
 	res, err := srv.createSheet(ctx, s)
@@ -117,6 +120,10 @@ type rawSheetInfo struct {
 //  | Benchmark2 |               15588 |             15717.6 |  ~      | (p=0.841 n=5+5) |
 //                                            ...
 //
+// If the table compares more than two configurations, the delta and note
+// columns are omitted. If the table has benchmarks from several packages, each
+// name is prefixed with the benchmark's package, which also keeps benchmarks
+// with the same name apart in the overview.
 func (srv *Service) createRawSheet(t *benchstat.Table, tIdx int) (*sheets.Sheet, rawSheetInfo) {
 	sheetID := sheetIDForTable(tIdx)
 
@@ -152,14 +159,16 @@ func (srv *Service) createRawSheet(t *benchstat.Table, tIdx int) (*sheets.Sheet,
 			metadata = append(metadata, withSize(150))
 		}
 
-		// Column: delta.
-		info.deltaCol = int64(len(vals))
-		vals = append(vals, strCell("delta"))
-		metadata = append(metadata, withSize(100))
+		if t.OldNewDelta {
+			// Column: delta.
+			info.deltaCol = int64(len(vals))
+			vals = append(vals, strCell("delta"))
+			metadata = append(metadata, withSize(100))
 
-		// Column: note.
-		vals = append(vals, strCell("note"))
-		metadata = append(metadata, withSize(150))
+			// Column: note.
+			vals = append(vals, strCell("note"))
+			metadata = append(metadata, withSize(150))
+		}
 
 		numCols = int64(len(vals))
 		data = append(data, &sheets.RowData{Values: vals})
@@ -168,10 +177,14 @@ func (srv *Service) createRawSheet(t *benchstat.Table, tIdx int) (*sheets.Sheet,
 	// Data rows.
 	for _, row := range t.Rows {
 		var vals []*sheets.CellData
-		vals = append(vals, strCell(row.Benchmark))
+		vals = append(vals, strCell(rowName(row)))
 		for _, val := range row.Metrics {
 			vals = append(vals, numCell(val.Mean))
 		}
+		if !t.OldNewDelta {
+			data = append(data, &sheets.RowData{Values: vals})
+			continue
+		}
 		if row.Delta == "~" {
 			vals = append(vals, strCell(row.Delta))
 		} else {
@@ -183,7 +196,10 @@ func (srv *Service) createRawSheet(t *benchstat.Table, tIdx int) (*sheets.Sheet,
 	}
 
 	// Conditional formatting.
-	cf := condFormatting(sheetID, info.deltaCol, isSmallerBetter(t))
+	var cfs []*sheets.ConditionalFormatRule
+	if t.OldNewDelta {
+		cfs = append(cfs, condFormatting(sheetID, info.deltaCol, isSmallerBetter(t)))
+	}
 
 	// Grid properties.
 	grid := &sheets.GridProperties{
@@ -201,11 +217,20 @@ func (srv *Service) createRawSheet(t *benchstat.Table, tIdx int) (*sheets.Sheet,
 			RowData:        data,
 			ColumnMetadata: metadata,
 		}},
-		ConditionalFormats: []*sheets.ConditionalFormatRule{cf},
+		ConditionalFormats: cfs,
 	}
 	return sheet, info
 }
 
+// rowName returns the name of the benchmark in the row, prefixed with its
+// package if the row belongs to one of several packages.
+func rowName(row *benchstat.Row) string {
+	if row.Group == "" {
+		return row.Benchmark
+	}
+	return strings.TrimPrefix(row.Group, "pkg:") + " " + row.Benchmark
+}
+
 // createRawSheet creates a new sheet that contains an overview of all raw
 // metric data using pivot tables. The sheet is formatted like:
 //
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"encoding/json"
+	"io"
+	"time"
+
+	"golang.org/x/perf/benchstat"
+)
+
+// jsonReportVersion is the version of the schema of the JSON report. It is
+// incremented whenever fields are removed or change meaning.
+const jsonReportVersion = 1
+
+// jsonReport is the comparison output with --json. See the README for a
+// description of the schema.
+type jsonReport struct {
+	Version     int              `json:"version"`
+	Time        string           `json:"time"` // of the run, as passed to --previous-run
+	Args        []string         `json:"args"`
+	Threshold   *float64         `json:"threshold,omitempty"`
+	Suites      []jsonSuite      `json:"suites"`
+	Comparisons []jsonComparison `json:"comparisons"`
+	Verdict     jsonVerdict      `json:"verdict"`
+}
+
+type jsonSuite struct {
+	Label       string         `json:"label"`
+	Ref         string         `json:"ref"`
+	Build       string         `json:"build,omitempty"` // build configuration
+	Timeouts    []benchTimeout `json:"timeouts,omitempty"`
+	Quarantined []benchFailure `json:"quarantined,omitempty"`
+}
+
+// jsonComparison compares a suite against the baseline.
+type jsonComparison struct {
+	Old     string       `json:"old"` // label of the baseline
+	New     string       `json:"new"` // label of the compared suite
+	Metrics []jsonMetric `json:"metrics"`
+}
+
+type jsonMetric struct {
+	Metric     string      `json:"metric"` // e.g. time/op
+	Unit       string      `json:"unit"`   // e.g. ns/op
+	Benchmarks []jsonBench `json:"benchmarks"`
+}
+
+type jsonBench struct {
+	Name    string      `json:"name"`              // as reported by benchstat, e.g. Encode-8
+	Package string      `json:"package,omitempty"` // import path, if known
+	Old     jsonSamples `json:"old"`
+	New     jsonSamples `json:"new"`
+	// DeltaPct is the change of the mean in percent, whether or not it is
+	// significant.
+	DeltaPct float64 `json:"delta_pct"`
+	// PValue is the p-value of the Mann-Whitney U-test, or null if it could
+	// not be computed, for instance because all samples are equal.
+	PValue      *float64 `json:"p_value"`
+	Significant bool     `json:"significant"` // p_value < alpha
+	Change      string   `json:"change"`      // better, worse or unchanged
+	Note        string   `json:"note,omitempty"`
+}
+
+type jsonSamples struct {
+	Mean float64 `json:"mean"`
+	Min  float64 `json:"min"`
+	Max  float64 `json:"max"`
+	// RangePct is the largest deviation of a sample from the mean in percent,
+	// as reported by benchstat with ±.
+	RangePct float64 `json:"range_pct"`
+	Samples  int     `json:"samples"` // number of samples, including outliers
+	Kept     int     `json:"kept"`    // number of samples after removing outliers
+}
+
+type jsonVerdict struct {
+	Passed bool   `json:"passed"`
+	Error  string `json:"error,omitempty"` // summary of the regressions
+	// Regressions lists the regressions that exceeded the threshold, worst
+	// first.
+	Regressions []jsonRegression `json:"regressions,omitempty"`
+}
+
+type jsonRegression struct {
+	Old       string  `json:"old"` // label of the baseline
+	New       string  `json:"new"` // label of the compared suite
+	Metric    string  `json:"metric"`
+	Benchmark string  `json:"benchmark"`
+	Package   string  `json:"package,omitempty"`
+	DeltaPct  float64 `json:"delta_pct"`
+}
+
+// newJSONReport returns the JSON report of the comparison tables of each suite
+// against the baseline, and of whether the regression threshold was met.
+func newJSONReport(
+	t time.Time,
+	args []string,
+	threshold float64,
+	bss []*benchSuite,
+	cmpTables [][]*benchstat.Table,
+	verdict error,
+) jsonReport {
+	r := jsonReport{
+		Version: jsonReportVersion,
+		Time:    t.Format(timeFormat),
+		Args:    args,
+		Verdict: jsonVerdict{Passed: verdict == nil},
+	}
+	if threshold >= 0 {
+		r.Threshold = &threshold
+	}
+	if verdict != nil {
+		r.Verdict.Error = verdict.Error()
+	}
+	if rErr, ok := verdict.(*regressionError); ok {
+		for _, reg := range rErr.regs {
+			r.Verdict.Regressions = append(r.Verdict.Regressions, jsonRegression{
+				Old:       reg.table.Configs[0],
+				New:       reg.table.Configs[1],
+				Metric:    reg.table.Metric,
+				Benchmark: reg.row.Benchmark,
+				Package:   rowPackage(reg.table, reg.row),
+				DeltaPct:  reg.row.PctDelta,
+			})
+		}
+	}
+	for _, bs := range bss {
+		r.Suites = append(r.Suites, jsonSuite{
+			Label:       bs.label,
+			Ref:         bs.ref,
+			Build:       bs.cfg.String(),
+			Timeouts:    bs.timeouts,
+			Quarantined: bs.quarantined,
+		})
+	}
+	for i, tables := range cmpTables {
+		c := jsonComparison{Old: bss[0].label, New: bss[i+1].label, Metrics: []jsonMetric{}}
+		for _, table := range tables {
+			m := jsonMetric{Metric: table.Metric, Benchmarks: []jsonBench{}}
+			for _, row := range table.Rows {
+				if len(row.Metrics) != 2 {
+					continue
+				}
+				oldM, newM := row.Metrics[0], row.Metrics[1]
+				m.Unit = oldM.Unit
+				b := newJSONBench(row, oldM, newM)
+				b.Package = rowPackage(table, row)
+				m.Benchmarks = append(m.Benchmarks, b)
+			}
+			c.Metrics = append(c.Metrics, m)
+		}
+		r.Comparisons = append(r.Comparisons, c)
+	}
+	return r
+}
+
+func newJSONBench(row *benchstat.Row, oldM, newM *benchstat.Metrics) jsonBench {
+	b := jsonBench{
+		Name:   row.Benchmark,
+		Old:    newJSONSamples(oldM),
+		New:    newJSONSamples(newM),
+		Change: "unchanged",
+		Note:   row.Note,
+	}
+	if oldM.Mean != 0 {
+		b.DeltaPct = (newM.Mean/oldM.Mean - 1) * 100
+	}
+	if pval, err := benchstat.UTest(oldM, newM); err == nil {
+		b.PValue = &pval
+		b.Significant = pval < significanceLevel
+	}
+	switch row.Change {
+	case +1:
+		b.Change = "better"
+	case -1:
+		b.Change = "worse"
+	}
+	return b
+}
+
+func newJSONSamples(m *benchstat.Metrics) jsonSamples {
+	return jsonSamples{
+		Mean:     m.Mean,
+		Min:      m.Min,
+		Max:      m.Max,
+		RangePct: metricsSpread(m) * 100,
+		Samples:  len(m.Values),
+		Kept:     len(m.RValues),
+	}
+}
+
+// formatJSON writes the JSON report, indented for readability.
+func formatJSON(w io.Writer, r jsonReport) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(r)
+}
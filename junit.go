@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/xml"
+	"fmt"
+	"strings"
+
+	"golang.org/x/perf/benchstat"
+)
+
+// JUnit XML report, as understood by most CI systems. Each comparison of a
+// suite against the baseline is a test suite, and each benchmark in each
+// metric is a test case, which fails if it regressed by more than the
+// regression threshold.
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Classname string        `xml:"classname,attr"` // the package and metric, e.g. pkg.time/op
+	Name      string        `xml:"name,attr"`      // the benchmark
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// writeJUnit writes the JUnit XML report of the comparison tables of each
+// suite against the baseline to the specified file. Without a threshold, no
+// test case fails.
+func writeJUnit(file string, thresh float64, bss []*benchSuite, cmpTables [][]*benchstat.Table) error {
+	var r junitTestSuites
+	for i, tables := range cmpTables {
+		regressed := make(map[*benchstat.Row]bool)
+		if thresh >= 0 {
+			for _, reg := range findRegressions(thresh, tables) {
+				regressed[reg.row] = true
+			}
+		}
+		s := junitTestSuite{Name: fmt.Sprintf("benchdiff: %s -> %s", bss[0].ref, bss[i+1].ref)}
+		for _, table := range tables {
+			for _, row := range table.Rows {
+				if len(row.Metrics) != 2 {
+					continue
+				}
+				classname := table.Metric
+				if pkg := rowPackage(table, row); pkg != "" {
+					classname = pkg + "." + table.Metric
+				}
+				c := junitTestCase{
+					Classname: classname,
+					Name:      row.Benchmark,
+					SystemOut: junitDetails(table, row),
+				}
+				if regressed[row] {
+					msg := fmt.Sprintf("%s regression in %s of %s exceeded threshold of %.2f%%",
+						table.Metric, row.Benchmark, row.Delta, thresh*100)
+					if pval, err := benchstat.UTest(row.Metrics[0], row.Metrics[1]); err == nil {
+						msg += fmt.Sprintf(" (p=%0.3f)", pval)
+					}
+					c.Failure = &junitFailure{Message: msg, Type: "regression", Body: c.SystemOut}
+					c.SystemOut = ""
+					s.Failures++
+				}
+				s.Cases = append(s.Cases, c)
+				s.Tests++
+			}
+		}
+		r.Suites = append(r.Suites, s)
+	}
+	b, err := xml.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(file, append([]byte(xml.Header), append(b, '\n')...))
+}
+
+// junitDetails describes the comparison of the benchmark in the row, like the
+// row of benchstat's text output.
+func junitDetails(table *benchstat.Table, row *benchstat.Row) string {
+	var buf strings.Builder
+	for i, m := range row.Metrics {
+		fmt.Fprintf(&buf, "%s: %s\n", table.Configs[i], strings.TrimSpace(m.Format(row.Scaler)))
+	}
+	fmt.Fprintf(&buf, "delta: %s %s\n", row.Delta, row.Note)
+	return buf.String()
+}
@@ -7,11 +7,16 @@ import (
 	"io"
 	"io/ioutil"
 	"math"
+	"math/rand"
 	"os"
 	"os/exec"
+	"os/signal"
 	"path/filepath"
 	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/nvanbenschoten/benchdiff/google"
@@ -21,7 +26,9 @@ import (
 	"golang.org/x/perf/benchstat"
 )
 
-const usage = `usage: benchdiff [--old <commit>] [--new <commit>] <pkgs>...`
+const usage = `usage: benchdiff [--old <commit>] [--new <commit>] <pkgs>...
+       benchdiff --ref <commit> --ref <commit> [--ref <commit>]... <pkgs>...
+       benchdiff bisect --old <commit> --new <commit> --threshold <n> <pkgs>...`
 
 const helpString = `benchdiff automates the process of running and comparing Go microbenchmarks
 across code changes.
@@ -30,6 +37,16 @@ benchdiff runs all microbenchmarks in the specified packages against the old and
 new commit. It then passes the benchmark output through benchstat to compute
 statistics about the results.
 
+If the --ref flag is passed repeatedly, benchdiff instead runs the
+microbenchmarks against each of the specified commits and compares all of them
+side-by-side. The first commit is treated as the baseline when checking the
+regression threshold.
+
+In bisect mode, benchdiff searches the first-parent commits between old and new
+for the first commit that introduced a regression exceeding the threshold. Each
+candidate commit is benchmarked interleaved with old, whose test binaries are
+only built once.
+
 By default, benchdiff outputs these results in a textual format. However, if the
 --sheets flag is passed then it will upload the result to a Google Sheets
 spreadsheet. To access this, users must have a Google service account. For
@@ -45,19 +62,94 @@ environment variable. See https://cloud.google.com/docs/authentication/productio
 
 Options:
   -n, --new       <commit>  measure the difference between this commit and old (default HEAD)
-  -o, --old       <commit>  measure the difference between this commit and new (default new~)
+                            or WORKTREE to measure uncommitted changes in the working tree
+  -o, --old       <commit>  measure the difference between this commit and new (default new~,
+                            or HEAD if new is WORKTREE)
+      --ref       <commit>  compare this commit against the others; repeat to compare more than
+                            two commits. A range A..B expands to A followed by each commit in
+                            A..B. Incompatible with --old and --new
   -r, --run       <regexp>  run only benchmarks matching regexp
   -c, --count     <n>       run tests and benchmarks n times (default 10)
   -d  --benchtime <d>       run each benchmark for duration d (default 1s)
+      --interleave <pkg|bench>
+                            alternate between the commits after running all benchmarks in a
+                            package, or after running each benchmark (default pkg)
+      --shuffle <off|on|n>  randomize the order of the benchmark runs in each of the count rounds,
+                            using n as the random seed. If on, a seed is chosen and logged
+      --adaptive            run benchmarks in rounds until their results are decisive, instead
+                            of exactly count times. After min-count rounds, benchmarks that
+                            changed significantly (p<0.01) or whose samples and change are all
+                            within the threshold (default 2%) are no longer run. At most count
+                            rounds are run
+      --min-count <n>       the minimum number of rounds with --adaptive (default 5)
+      --budget <d>          with --adaptive, start no new rounds after duration d, e.g. 30m
+      --max-duration <d>    stop running benchmarks after duration d, once the current round of
+                            runs completes, and report the results collected so far. Each round
+                            runs every package, or benchmark, once per commit
+      --timeout <d>         kill a test binary that runs for longer than d and record the
+                            benchmark it was running as timed out
+      --bench-timeout <d>   kill a test binary if a single benchmark runs for longer than d,
+                            detected by the binary producing no output for d. Benchmarks that
+                            timed out are not run again for that commit and are listed
+                            separately from the results; the rest of the package still runs
+      --retries <n>         retry a benchmark that fails up to n times (default 1). Benchmarks
+                            that fail on every attempt for either commit are excluded from the
+                            comparison and listed with their failure output
+      --resume <time>       time of an interrupted run; continue it with the same flags and
+                            commits, appending to its output. Incompatible with other flags
       --cpuprofile          record and write cpu profiles
       --memprofile          record and write allocation profiles
       --mutexprofile        record and write mutex contention profiles
-  -t, --threshold <n>       exit with code 0 if all regressions are below threshold, else 1
+      --blockprofile        record and write goroutine blocking profiles
+      --trace               record and write execution traces
+                            Profiles are merged per package and per commit, while traces are
+                            kept per package and iteration. With text or HTML output, the
+                            functions with the largest change in each profile relative to the
+                            old commit are reported alongside the results
+      --memprofilerate <n>  set runtime.MemProfileRate in the test binaries; 1 records every
+                            allocation, at the cost of slowing down the benchmarks
+      --profile-benchmarks  after the comparison, run each benchmark in isolation with profiling
+                            enabled (cpu unless another profile is requested) and write one
+                            profile per benchmark. The comparison itself is not profiled
+      --profile-regressions like --profile-benchmarks, but only for the benchmarks that exceeded
+                            the regression threshold. Requires --threshold
+  -t, --threshold <n>       exit with code 0 if all regressions are below threshold, else list
+                            every regression that exceeded it, worst first, and exit with code 1.
+                            benchdiff exits with code 2 if it fails for any other reason
   -p, --previous-run <time> time of previous run; skip running benches and just (re)process previous run
       --post-checkout       an optional command to run after checking out each branch to
                             configure the git repo so that 'go build' succeeds
+      --worktree            build each commit in a git worktree under ./benchdiff, which is
+                            shared by all commits, instead of checking it out in the current
+                            working directory (implied when either commit is WORKTREE)
+  -j, --build-jobs <n>      build up to n test binaries concurrently (default 1)
+      --build-flags <flags> additional flags to pass to 'go test -c' and 'go list' when
+                            building test binaries, e.g. '-tags=foo -gcflags=-B'
+      --build-env <k=v>     set an environment variable when building test binaries, e.g.
+                            'GOAMD64=v3'; can be repeated
+      --old-build-flags, --new-build-flags <flags>
+                            additional build flags for the old or new commit only
+      --old-build-env, --new-build-env <k=v>
+                            additional build environment variables for the old or new commit
+                            only; can be repeated
+      --pgo <file|auto>     measure the effect of profile-guided optimization by building the new
+                            commit with and without -pgo=<file>. If auto, the profile is merged
+                            from the cpu profiles of the latest run of the new commit with
+                            --cpuprofile
+      --old-go, --new-go <path>
+                            the go binary, or GOROOT, of the toolchain used to build the old or
+                            new commit (default go on the PATH). Results are labeled with the
+                            toolchain versions
+  -k, --keep-going          skip packages that fail to build for some commits instead of
+                            exiting, and benchmark the packages that built for all commits
       --csv                 output the results in a csv format
       --html                output the results in an HTML table
+      --json                output the results, and whether they met the threshold, as JSON.
+                            The schema is described in the README
+      --markdown            output the results as GitHub-flavored markdown tables, e.g. for pull
+                            request comments, with a summary and the unchanged rows collapsed
+      --junit <file>        also write a JUnit XML report to file, with a test case per metric
+                            and benchmark that fails if the benchmark exceeded the threshold
       --sheets              output the results to a new Google Sheets document
       --help                display this help
 
@@ -65,6 +157,17 @@ Example invocations:
   $ benchdiff --sheets ./pkg/...
   $ benchdiff --old=master~ --new=master --threshold=0.2 ./pkg/kv ./pkg/storage/...
   $ benchdiff --new=d1fbdb2 --run=Datum --count=2 --csv ./pkg/sql/...
+  $ benchdiff --interleave=bench --shuffle=on ./pkg/sql/...
+  $ benchdiff --adaptive --count=30 --budget=1h ./pkg/sql/...
+  $ benchdiff --new=WORKTREE --run=Datum ./pkg/sql/...
+  $ benchdiff --threshold=0.05 --profile-regressions ./pkg/sql/...
+  $ benchdiff --threshold=0.05 --markdown ./pkg/kv > comment.md
+  $ benchdiff --old=master --new=master --new-build-env=GOAMD64=v3 ./pkg/util/...
+  $ benchdiff --old=HEAD --new=HEAD --old-go=/usr/local/go1.14 --new-go=/usr/local/go1.15 ./pkg/util/...
+  $ benchdiff --pgo=auto ./pkg/sql/...
+  $ benchdiff --ref=master --ref=d1fbdb2 --ref=6299bd4 ./pkg/kv
+  $ benchdiff --ref=master..my-branch ./pkg/kv
+  $ benchdiff bisect --old=v20.1.0 --new=master --run=BenchmarkScan --threshold=0.05 ./pkg/kv
   $ benchdiff --new=6299bd4 --sheets --post-checkout='dev generate go' ./pkg/workload/...`
 
 // TODO: it's unclear whether G Suite Domain-wide Delegation is required for the
@@ -115,135 +218,575 @@ const (
 	//
 	//   generated sheet: https://docs.google.com/spreadsheets/...
 	sheets
+	// Output the benchmark comparison, along with whether it met the
+	// regression threshold, as JSON to stdout. See the README for the schema.
+	//
+	// Example:
+	//   {
+	//     "version": 1,
+	//     "time": "2020-10-22T14_02_24-04:00",
+	//     ...
+	//     "verdict": {
+	//       "passed": true
+	//     }
+	//   }
+	jsonFmt
+	// Output the benchmark comparison as GitHub-flavored markdown tables to
+	// stdout, preceded by a summary that includes whether the comparison met
+	// the regression threshold. Rows without a significant change are
+	// collapsed.
+	//
+	// Example:
+	//   | name | old | new | delta | |
+	//   | --- | ---: | ---: | ---: | --- |
+	//   | String-8 | 68.6ns ± 0% | 72.2ns ± 1% | 🔴 +5.25% | (p=0.008 n=5+5) |
+	markdown
 )
 
+// writtenAfterVerdict returns whether the output includes the verdict of the
+// regression threshold, and is therefore written once that has been checked.
+func (out outputFmt) writtenAfterVerdict() bool {
+	return out == jsonFmt || out == markdown
+}
+
+// logWriter returns the writer that informational messages, like the location
+// of profiles, are written to alongside the output. Machine-readable output
+// and output meant to be pasted as a whole keep stdout to themselves.
+func (out outputFmt) logWriter() io.Writer {
+	if out == jsonFmt || out == markdown {
+		return os.Stderr
+	}
+	return os.Stdout
+}
+
+// significanceLevel is the p-value below which benchstat considers a change
+// significant.
+const significanceLevel = 0.05
+
 const timeFormat = "2006-01-02T15_04_05Z07:00"
 
+// worktreeRef is a pseudo git ref that refers to the current working tree,
+// including any staged and unstaged changes.
+const worktreeRef = "WORKTREE"
+
+// errInterrupted is returned when benchdiff is interrupted by a signal.
+var errInterrupted = errors.New("interrupted")
+
 func main() {
-	if err := run(context.Background()); err != nil {
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// Cancel the context on the first SIGINT or SIGTERM, which kills running
+	// subprocesses and lets benchdiff restore the checkout and report partial
+	// results. Exit immediately on the second.
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-sigCh
+		fmt.Fprintf(os.Stderr, "\nreceived %s; stopping (send again to exit immediately)\n", sig)
+		cancel()
+		<-sigCh
+		os.Exit(2)
+	}()
+	if err := run(ctx); err != nil {
+		// Distinguish regressions from failures of benchdiff itself.
+		if _, ok := errors.Cause(err).(*regressionError); ok {
+			fmt.Fprintf(os.Stderr, "%s\n", err)
+			os.Exit(1)
+		}
 		fmt.Fprintf(os.Stderr, "fatal: %s\n", err)
-		os.Exit(1)
+		os.Exit(2)
 	}
 }
 
+// interrupted returns whether err, or the canceled context, indicates that
+// benchdiff was interrupted.
+func interrupted(ctx context.Context, err error) bool {
+	return errors.Cause(err) == errInterrupted || ctx.Err() != nil
+}
+
 func run(ctx context.Context) error {
-	var help, outCSV, outHTML, outSheets bool
+	var help, outCSV, outHTML, outSheets, outJSON, outMarkdown bool
+	var junitFile string
 	var oldRef, newRef, postChck, runPattern, benchTime, previousRun string
 	var itersPerTest int
-	var cpuProfile, memProfile, mutexProfile bool
+	var memProfileRate int
+	var interleave, shuffle string
+	var adaptive bool
+	var minCount int
+	var budget, maxDuration time.Duration
+	var timeout, benchTimeout time.Duration
+	var retries int
+	var resume string
+	var profileBenchmarks, profileRegressions bool
 	var threshold float64
+	var worktree bool
+	var buildJobs int
+	var keepGoing bool
+	var buildFlags, oldBuildFlags, newBuildFlags string
+	var buildEnv, oldBuildEnv, newBuildEnv []string
+	var oldGo, newGo string
+	var pgoProfile string
+	var refArgs []string
 
 	pflag.Usage = func() { fmt.Fprintln(os.Stderr, usage) }
 	pflag.BoolVarP(&help, "help", "h", false, "")
 	pflag.BoolVarP(&outCSV, "csv", "", false, "")
 	pflag.BoolVarP(&outHTML, "html", "", false, "")
 	pflag.BoolVarP(&outSheets, "sheets", "", false, "")
+	pflag.BoolVarP(&outJSON, "json", "", false, "")
+	pflag.BoolVarP(&outMarkdown, "markdown", "", false, "")
+	pflag.StringVarP(&junitFile, "junit", "", "", "")
 	pflag.StringVarP(&oldRef, "old", "o", "", "")
 	pflag.StringVarP(&newRef, "new", "n", "", "")
+	pflag.StringArrayVarP(&refArgs, "ref", "", nil, "")
 	pflag.StringVarP(&postChck, "post-checkout", "", "", "")
 	pflag.StringVarP(&runPattern, "run", "r", ".", "")
 	pflag.IntVarP(&itersPerTest, "count", "c", 10, "")
+	pflag.StringVarP(&interleave, "interleave", "", interleavePkg, "")
+	pflag.StringVarP(&shuffle, "shuffle", "", "off", "")
+	pflag.Lookup("shuffle").NoOptDefVal = "on"
+	pflag.BoolVarP(&adaptive, "adaptive", "", false, "")
+	pflag.IntVarP(&minCount, "min-count", "", 5, "")
+	pflag.DurationVarP(&budget, "budget", "", 0, "")
+	pflag.DurationVarP(&maxDuration, "max-duration", "", 0, "")
+	pflag.DurationVarP(&timeout, "timeout", "", 0, "")
+	pflag.DurationVarP(&benchTimeout, "bench-timeout", "", 0, "")
+	pflag.IntVarP(&retries, "retries", "", 1, "")
 	pflag.StringVarP(&benchTime, "benchtime", "d", "", "")
-	pflag.BoolVarP(&cpuProfile, "cpuprofile", "", false, "")
-	pflag.BoolVarP(&memProfile, "memprofile", "", false, "")
-	pflag.BoolVarP(&mutexProfile, "mutexprofile", "", false, "")
+	profEnabled := make(map[string]*bool, len(profileTypes))
+	for _, pt := range profileTypes {
+		profEnabled[pt.name] = pflag.BoolP(pt.flag, "", false, "")
+	}
+	pflag.IntVarP(&memProfileRate, "memprofilerate", "", 0, "")
+	pflag.BoolVarP(&profileBenchmarks, "profile-benchmarks", "", false, "")
+	pflag.BoolVarP(&profileRegressions, "profile-regressions", "", false, "")
 	pflag.Float64VarP(&threshold, "threshold", "t", -1, "")
 	pflag.StringVarP(&previousRun, "previous-run", "p", "", "")
+	pflag.StringVarP(&resume, "resume", "", "", "")
+	pflag.BoolVarP(&worktree, "worktree", "", false, "")
+	pflag.IntVarP(&buildJobs, "build-jobs", "j", 1, "")
+	pflag.BoolVarP(&keepGoing, "keep-going", "k", false, "")
+	pflag.StringVarP(&buildFlags, "build-flags", "", "", "")
+	pflag.StringVarP(&oldBuildFlags, "old-build-flags", "", "", "")
+	pflag.StringVarP(&newBuildFlags, "new-build-flags", "", "", "")
+	pflag.StringArrayVarP(&buildEnv, "build-env", "", nil, "")
+	pflag.StringArrayVarP(&oldBuildEnv, "old-build-env", "", nil, "")
+	pflag.StringArrayVarP(&newBuildEnv, "new-build-env", "", nil, "")
+	pflag.StringVarP(&oldGo, "old-go", "", "", "")
+	pflag.StringVarP(&newGo, "new-go", "", "", "")
+	pflag.StringVarP(&pgoProfile, "pgo", "", "", "")
 	pflag.Parse()
 	prArgs := pflag.Args()
 
 	if help {
 		return runHelp(ctx)
 	}
+	var st *runState
+	if resume != "" {
+		if pflag.NFlag() != 1 || len(prArgs) > 0 {
+			return errors.New("--resume incompatible with other flags and arguments")
+		}
+		var err error
+		if st, err = loadRunState(resume); err != nil {
+			return err
+		}
+		// Restore the flags and arguments of the run.
+		if err := pflag.CommandLine.Parse(st.Args); err != nil {
+			return err
+		}
+		prArgs = pflag.Args()
+		if shuffle == "on" {
+			shuffle = strconv.FormatInt(st.Seed, 10)
+		}
+	}
+	if buildJobs < 1 {
+		return errors.New("--build-jobs must be positive")
+	}
+	if interleave != interleavePkg && interleave != interleaveBench {
+		return errors.Errorf("--interleave must be %s or %s", interleavePkg, interleaveBench)
+	}
+	rng, seed, err := parseShuffle(shuffle)
+	if err != nil {
+		return err
+	}
+	if adaptive && (minCount < 1 || minCount > itersPerTest) {
+		return errors.New("--min-count must be positive and at most --count")
+	}
+	if budget != 0 && !adaptive {
+		return errors.New("--budget requires --adaptive")
+	}
+	var profTypes []string
+	for _, pt := range profileTypes {
+		if *profEnabled[pt.name] {
+			profTypes = append(profTypes, pt.name)
+		}
+	}
+	perBench := profileBenchmarks || profileRegressions
+	if perBench {
+		if profileBenchmarks && profileRegressions {
+			return errors.New("--profile-benchmarks incompatible with --profile-regressions")
+		}
+		if previousRun != "" {
+			return errors.New("--profile-benchmarks and --profile-regressions incompatible with --previous-run")
+		}
+		if profileRegressions && threshold < 0 {
+			return errors.New("--profile-regressions requires --threshold")
+		}
+		if len(profTypes) == 0 {
+			profTypes = []string{"cpu"}
+		}
+	}
+	// The types of the profiles recorded while running the comparison, as
+	// opposed to while running each benchmark in isolation.
+	runProfTypes := profTypes
+	if perBench {
+		runProfTypes = nil
+	}
+	oldCfg, err := parseBuildConfig(oldGo, buildFlags, oldBuildFlags, buildEnv, oldBuildEnv)
+	if err != nil {
+		return err
+	}
+	newCfg, err := parseBuildConfig(newGo, buildFlags, newBuildFlags, buildEnv, newBuildEnv)
+	if err != nil {
+		return err
+	}
 	if len(prArgs) == 0 && previousRun == "" {
 		return runHelp(ctx)
 	}
+	if len(prArgs) > 0 && prArgs[0] == "bisect" {
+		if len(prArgs) == 1 {
+			return runHelp(ctx)
+		}
+		if pgoProfile != "" {
+			return errors.New("--pgo incompatible with bisect")
+		}
+		pkgFilter := prArgs[1:]
+		sort.Strings(pkgFilter)
+		oldRef, newRef, err := parseGitRefs(oldRef, newRef)
+		if err != nil {
+			return err
+		}
+		bo := buildOpts{postChck: postChck, worktree: worktree, jobs: buildJobs, keepGoing: keepGoing}
+		return runBisect(
+			ctx, oldRef, newRef, oldCfg, newCfg, pkgFilter, bo,
+			runPattern, benchTime, itersPerTest,
+			timeoutOpts{run: timeout, bench: benchTimeout}, retries, threshold,
+		)
+	}
 	pkgFilter := prArgs
 	sort.Strings(pkgFilter)
 
 	// Parse the output format.
-	var out outputFmt
+	out := text
+	var outFlags []string
+	for _, f := range []struct {
+		flag string
+		set  bool
+		out  outputFmt
+	}{
+		{"csv", outCSV, csv},
+		{"html", outHTML, html},
+		{"sheets", outSheets, sheets},
+		{"json", outJSON, jsonFmt},
+		{"markdown", outMarkdown, markdown},
+	} {
+		if f.set {
+			outFlags = append(outFlags, f.flag)
+			out = f.out
+		}
+	}
+	if len(outFlags) > 1 {
+		return errors.Errorf("--%s and --%s incompatible", outFlags[0], outFlags[1])
+	}
 	var srv *google.Service
-	var err error
-	switch {
-	case outCSV:
-		if outHTML {
-			return errors.New("--csv and --html incompatible")
-		} else if outSheets {
-			return errors.New("--csv and --sheets incompatible")
-		}
-		out = csv
-	case outHTML:
-		if outSheets {
-			return errors.New("--html and --sheets incompatible")
-		}
-		out = html
-	case outSheets:
-		out = sheets
+	if out == sheets {
 		// Init the Google service ASAP to detect credential issues.
 		if srv, err = google.New(ctx); err != nil {
 			return err
 		}
-	default:
-		out = text
 	}
 
 	// Parse the specified git refs.
-	oldRef, newRef, err = parseGitRefs(oldRef, newRef)
-	if err != nil {
-		return err
+	var refs, labels []string
+	var cfgs []buildConfig
+	sideSpecific := oldBuildFlags != "" || newBuildFlags != "" ||
+		len(oldBuildEnv) > 0 || len(newBuildEnv) > 0 || oldGo != "" || newGo != ""
+	if len(refArgs) > 0 {
+		if oldRef != "" || newRef != "" {
+			return errors.New("--ref incompatible with --old and --new")
+		}
+		if pgoProfile != "" {
+			return errors.New("--ref incompatible with --pgo")
+		}
+		if sideSpecific {
+			return errors.New("--ref incompatible with --old-build-*, --new-build-*, --old-go, and --new-go")
+		}
+		if refs, err = parseGitRefList(refArgs); err != nil {
+			return err
+		}
+		labels = refs
+		for range refs {
+			cfgs = append(cfgs, oldCfg)
+		}
+	} else if pgoProfile != "" {
+		if oldRef != "" {
+			return errors.New("--pgo incompatible with --old")
+		}
+		if sideSpecific {
+			return errors.New("--pgo incompatible with --old-build-*, --new-build-*, --old-go, and --new-go")
+		}
+		if newRef == "" {
+			if newRef, err = getCurRef(); err != nil {
+				return err
+			}
+		}
+		if newRef, err = resolveGitRef(newRef); err != nil {
+			return err
+		}
+		refs = []string{newRef, newRef}
+		// With auto, the profile is generated from an earlier run.
+		before := time.Now()
+		if st != nil {
+			before = st.time()
+		} else if previousRun != "" {
+			if before, err = time.Parse(timeFormat, previousRun); err != nil {
+				return err
+			}
+		}
+		if cfgs, labels, err = pgoConfigs(newRef, oldCfg, pgoProfile, before); err != nil {
+			return err
+		}
+	} else {
+		oldRef, newRef, err = parseGitRefs(oldRef, newRef)
+		if err != nil {
+			return err
+		}
+		refs = []string{oldRef, newRef}
+		labels = []string{"old", "new"}
+		cfgs = []buildConfig{oldCfg, newCfg}
+		if oldGo != "" || newGo != "" {
+			if labels, err = toolchainLabels(cfgs); err != nil {
+				return err
+			}
+		}
+	}
+	if st != nil {
+		if refs, err = st.resumeRefs(refs); err != nil {
+			return err
+		}
 	}
+	for _, ref := range refs {
+		if ref == worktreeRef {
+			// Never check out other refs over uncommitted changes.
+			worktree = true
+		}
+	}
+	bo := buildOpts{postChck: postChck, worktree: worktree, jobs: buildJobs, keepGoing: keepGoing}
 
 	// Build the benchmark suites.
-	oldSuite := makeBenchSuite(oldRef)
-	newSuite := makeBenchSuite(newRef)
-	defer oldSuite.close()
-	defer newSuite.close()
+	suites := make([]*benchSuite, len(refs))
+	ids := make(map[string]struct{}, len(refs))
+	for i, ref := range refs {
+		bs := makeBenchSuite(ref, labels[i], cfgs[i])
+		bs.timeout = timeoutOpts{run: timeout, bench: benchTimeout}
+		bs.retries = retries
+		if _, ok := ids[bs.id]; ok {
+			return errors.Errorf("'%s' specified more than once with the same build configuration", ref)
+		}
+		ids[bs.id] = struct{}{}
+		suites[i] = &bs
+		defer bs.close()
+	}
 
+	var tests fileSet
+	var runTime time.Time // used to uniquely name artifact files
 	if previousRun == "" {
-		if err := buildBenches(ctx, pkgFilter, postChck, &oldSuite, &newSuite); err != nil {
+		runTime = time.Now()
+		if st != nil {
+			runTime = st.time()
+		}
+		if err := buildBenches(ctx, pkgFilter, bo, runTime, suites...); err != nil {
 			return err
 		}
 
-		// Run the benchmarks.
-		tests := oldSuite.intersectTests(&newSuite)
-		err = runCmpBenches(
-			ctx, &oldSuite, &newSuite, tests.sorted(), runPattern,
-			benchTime, cpuProfile, memProfile, mutexProfile, itersPerTest,
-		)
+		// Run the benchmarks, recording progress so that the run can be resumed.
+		tests = intersectTests(suites)
+		var targets []benchTarget
+		if st == nil {
+			targets = pkgTargets(tests.sorted(), runPattern)
+			if interleave == interleaveBench {
+				if targets, err = listBenchTargets(suites, tests.sorted(), runPattern); err != nil {
+					return err
+				}
+			}
+			st = newRunState(runTime, os.Args[1:], seed, suites, targets)
+		} else {
+			targets = st.targets()
+			if err := st.restoreOutput(suites); err != nil {
+				return err
+			}
+			st.logResume()
+		}
+		if err := st.save(); err != nil {
+			return err
+		}
+		po := profileOpts{types: runProfTypes, memProfileRate: memProfileRate}
+		if adaptive {
+			ao := adaptiveOpts{
+				minCount: minCount,
+				maxCount: itersPerTest,
+				budget:   budget,
+				margin:   defaultAdaptiveMargin,
+			}
+			if threshold > 0 {
+				ao.margin = threshold
+			}
+			if maxDuration != 0 && (budget == 0 || maxDuration < budget) {
+				ao.budget = maxDuration
+			}
+			err = runAdaptiveBenches(ctx, suites, targets, runPattern, benchTime, po, ao, rng, st)
+		} else {
+			err = runCmpBenches(ctx, suites, targets, benchTime, po, itersPerTest, rng, maxDuration, st)
+		}
 		if err != nil {
+			if interrupted(ctx, err) {
+				logPartialResults(out.logWriter(), suites, st)
+				return errInterrupted
+			}
 			return err
 		}
+		err = mergeBenchProfiles(suites, tests.sorted(), runProfTypes)
+		if err != nil {
+			return err
+		}
+		if profileBenchmarks {
+			targets, err := listBenchTargets(suites, tests.sorted(), runPattern)
+			if err != nil {
+				return err
+			}
+			po := profileOpts{types: profTypes, memProfileRate: memProfileRate}
+			if err := profileBenchTargets(ctx, suites, targets, benchTime, po); err != nil {
+				return err
+			}
+		}
 	} else {
 		// Find output files for the given run.
-		t, err := time.Parse(timeFormat, previousRun)
+		runTime, err = time.Parse(timeFormat, previousRun)
 		if err != nil {
 			return err
 		}
 
 		// Install existing artifacts into benchSuites.
-		oldSuite.artDir = testArtifactsDir(oldSuite.ref)
-		oldSuite.outFile, err = os.Open(oldSuite.getOutputFile(t))
-		if err != nil {
-			return err
+		var found []string
+		for _, bs := range suites {
+			bs.artDir = testArtifactsDir(bs.id)
+			bs.setProfileDir(runTime)
+			bs.outFile, err = os.Open(bs.getOutputFile(runTime))
+			if err != nil {
+				return err
+			}
+			found = append(found, fmt.Sprintf("%s=%s", bs.label, bs.outFile.Name()))
 		}
-		newSuite.artDir = testArtifactsDir(newSuite.ref)
-		newSuite.outFile, err = os.Open(newSuite.getOutputFile(t))
+
+		fmt.Fprintf(os.Stderr, "Found previous run; %s\n", strings.Join(found, ", "))
+	}
+	// Compare the profiles of each suite against the baseline.
+	diffProfTypes := profTypes
+	if profileRegressions {
+		// Regressions are profiled after processing the benchmark output.
+		diffProfTypes = nil
+	}
+	var diffs []*profileDiff
+	if out == text || out == html || out == sheets {
+		diffs, err = diffBenchProfiles(suites, diffProfTypes)
 		if err != nil {
 			return err
 		}
-
-		fmt.Fprintf(os.Stderr, "Found previous run; old=%s, new=%s\n", oldSuite.outFile.Name(), newSuite.outFile.Name())
 	}
+
 	// Process the benchmark output.
-	res, err := processBenchOutput(ctx, &oldSuite, &newSuite, out, pkgFilter, srv)
+	res, err := processBenchOutput(ctx, suites, out, pkgFilter, srv, diffs)
 	if err != nil {
 		return err
 	}
-	logProfileLocations(&oldSuite, &newSuite, cpuProfile, memProfile, mutexProfile)
+	logProfileLocations(out.logWriter(), suites, diffProfTypes)
+	if tests != nil {
+		logSkippedTests(suites, tests)
+	}
+	logTimeouts(suites)
+	logQuarantined(suites)
+
+	// Tables comparing more than two suites do not include deltas, so compare
+	// each suite against the baseline individually.
+	cmpTables := [][]*benchstat.Table{res}
+	if len(suites) > 2 {
+		cmpTables = cmpTables[:0]
+		for _, bs := range suites[1:] {
+			res, err := collectBenchOutput(suites[0], bs)
+			if err != nil {
+				return err
+			}
+			cmpTables = append(cmpTables, res)
+		}
+	}
+
+	if profileRegressions {
+		var regressed []benchKey
+		for _, res := range cmpTables {
+			for _, r := range findRegressions(threshold, res) {
+				regressed = append(regressed, benchKey{
+					test: rowTestBin(r.table, r.row),
+					name: "Benchmark" + r.row.Benchmark,
+				})
+			}
+		}
+		po := profileOpts{types: profTypes, memProfileRate: memProfileRate}
+		err := profileRegressedBenches(ctx, suites, tests.sorted(), regressed, out, runPattern, benchTime, po)
+		if err != nil {
+			return err
+		}
+	}
 
 	// Determine whether any tests exceeded the allowable regression threshold.
-	return checkPassing(threshold, res)
+	verdict := checkComparisons(threshold, suites, cmpTables)
+	if junitFile != "" {
+		if err := writeJUnit(junitFile, threshold, suites, cmpTables); err != nil {
+			return errors.Wrap(err, "writing JUnit report")
+		}
+	}
+	switch out {
+	case jsonFmt:
+		args := os.Args[1:]
+		if st != nil {
+			args = st.Args
+		}
+		r := newJSONReport(runTime, args, threshold, suites, cmpTables, verdict)
+		if err := formatJSON(os.Stdout, r); err != nil {
+			return err
+		}
+	case markdown:
+		formatMarkdown(os.Stdout, suites, pkgFilter, itersPerTest, threshold, cmpTables, verdict)
+	}
+	return verdict
+}
+
+// checkComparisons checks each of the comparisons of a suite against the
+// baseline against the regression threshold, and returns a *regressionError
+// listing the regressions of all comparisons, if any.
+func checkComparisons(thresh float64, bss []*benchSuite, cmpTables [][]*benchstat.Table) error {
+	if thresh < 0 {
+		return nil
+	}
+	var regs []regression
+	for i, res := range cmpTables {
+		for _, r := range findRegressions(thresh, res) {
+			if len(bss) > 2 {
+				r.comparison = fmt.Sprintf("%s -> %s", bss[0].ref, bss[i+1].ref)
+			}
+			regs = append(regs, r)
+		}
+	}
+	return newRegressionError(thresh, regs)
 }
 
 func runHelp(ctx context.Context) error {
@@ -260,83 +803,292 @@ func parseGitRefs(oldRef, newRef string) (string, string, error) {
 		if err != nil {
 			return "", "", err
 		}
-	} else {
-		newRef, err = getRefAsSHA(newRef)
+	}
+	if newRef, err = resolveGitRef(newRef); err != nil {
+		return "", "", err
+	}
+
+	if oldRef == "" {
+		if newRef == worktreeRef {
+			// Compare uncommitted changes against HEAD.
+			oldRef, err = getCurRef()
+		} else {
+			oldRef, err = getPrevRef(newRef)
+		}
 		if err != nil {
 			return "", "", err
 		}
 	}
-	newRef = shortenRef(newRef)
-	if ok, err := checkValidRef(newRef); err != nil {
+	if oldRef, err = resolveGitRef(oldRef); err != nil {
 		return "", "", err
+	}
+
+	return oldRef, newRef, nil
+}
+
+// resolveGitRef resolves the provided git ref to a shortened SHA and verifies
+// that it is valid. The worktreeRef pseudo-ref is returned unchanged.
+func resolveGitRef(ref string) (string, error) {
+	if ref == worktreeRef {
+		return ref, nil
+	}
+	ref, err := getRefAsSHA(ref)
+	if err != nil {
+		return "", err
+	}
+	ref = shortenRef(ref)
+	if ok, err := checkValidRef(ref); err != nil {
+		return "", err
 	} else if !ok {
-		return "", "", errors.Errorf("invalid git ref %q", newRef)
+		return "", errors.Errorf("invalid git ref %q", ref)
 	}
+	return ref, nil
+}
 
-	if oldRef == "" {
-		oldRef, err = getPrevRef(newRef)
+// parseBuildConfig parses the go toolchain, build flags, and environment
+// variables specified on the command line into a buildConfig. The side-specific
+// flags and environment variables are applied after the common ones.
+func parseBuildConfig(
+	goBin, flags, sideFlags string, env, sideEnv []string,
+) (buildConfig, error) {
+	var cfg buildConfig
+	var err error
+	if cfg.goBin, err = parseGoBin(goBin); err != nil {
+		return buildConfig{}, err
+	}
+	if cfg.goBin != "" {
+		if cfg.goroot, err = lookupGoRoot(cfg.goBin); err != nil {
+			return buildConfig{}, err
+		}
+	}
+	for _, f := range []string{flags, sideFlags} {
+		args, err := splitArgs(f)
 		if err != nil {
-			return "", "", err
+			return buildConfig{}, errors.Wrap(err, "parsing build flags")
 		}
-	} else {
-		oldRef, err = getRefAsSHA(oldRef)
+		cfg.flags = append(cfg.flags, args...)
+	}
+	for _, e := range [][]string{env, sideEnv} {
+		vars, err := parseBuildEnv(e)
 		if err != nil {
-			return "", "", err
+			return buildConfig{}, err
 		}
+		cfg.env = append(cfg.env, vars...)
 	}
-	oldRef = shortenRef(oldRef)
-	if ok, err := checkValidRef(oldRef); err != nil {
-		return "", "", err
-	} else if !ok {
-		return "", "", errors.Errorf("invalid git ref %q", oldRef)
+	return cfg, nil
+}
+
+// toolchainLabels returns labels for benchmark suites built with the provided
+// buildConfigs that name the suites' go toolchain versions. If the versions
+// are not unique, the suites are labeled old and new instead.
+func toolchainLabels(cfgs []buildConfig) ([]string, error) {
+	labels := make([]string, len(cfgs))
+	seen := make(map[string]struct{}, len(cfgs))
+	for i, cfg := range cfgs {
+		v, err := getGoVersionName(cfg)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := seen[v]; ok {
+			return []string{"old", "new"}, nil
+		}
+		seen[v] = struct{}{}
+		labels[i] = v
 	}
+	return labels, nil
+}
 
-	return oldRef, newRef, nil
+// parseGitRefList parses the git refs specified through the --ref flag. Each
+// ref may be a range of the form A..B, which expands to A followed by each
+// commit reachable from B but not from A, oldest first.
+func parseGitRefList(refArgs []string) ([]string, error) {
+	var refs []string
+	seen := make(map[string]struct{})
+	for _, arg := range refArgs {
+		var expanded []string
+		if i := strings.Index(arg, ".."); i >= 0 && arg != worktreeRef {
+			from, to := arg[:i], arg[i+len(".."):]
+			if from == "" || to == "" || strings.HasPrefix(to, ".") {
+				return nil, errors.Errorf("invalid git ref range %q", arg)
+			}
+			commits, err := getRefRange(from, to)
+			if err != nil {
+				return nil, err
+			}
+			expanded = append([]string{from}, commits...)
+		} else {
+			expanded = []string{arg}
+		}
+		for _, ref := range expanded {
+			ref, err := resolveGitRef(ref)
+			if err != nil {
+				return nil, err
+			}
+			if _, ok := seen[ref]; ok {
+				return nil, errors.Errorf("git ref %q specified more than once", ref)
+			}
+			seen[ref] = struct{}{}
+			refs = append(refs, ref)
+		}
+	}
+	if len(refs) < 2 {
+		return nil, errors.New("at least two git refs must be specified with --ref")
+	}
+	return refs, nil
+}
+
+// buildOpts configures how benchmark suites are built.
+type buildOpts struct {
+	// postChck is an optional command to run after checking out each ref.
+	postChck string
+	// worktree indicates that each ref should be built in benchdiff's git
+	// worktree instead of being checked out in the current working directory.
+	worktree bool
+	// jobs is the number of test binaries to build concurrently.
+	jobs int
+	// keepGoing indicates that packages which fail to build should be
+	// recorded and skipped instead of failing the build.
+	keepGoing bool
 }
 
-func buildBenches(ctx context.Context, pkgFilter []string, postChck string, bss ...*benchSuite) error {
-	// Get the current branch so we can revert to it after, if possible.
-	if ref, ok, err := getCurSymbolicRef(); err != nil {
+// buildBenches builds the test binaries of each benchmark suite and creates
+// their output files for the run at the specified time.
+func buildBenches(
+	ctx context.Context, pkgFilter []string, bo buildOpts, t time.Time, bss ...*benchSuite,
+) error {
+	restore, err := saveCheckout(bo)
+	if err != nil {
 		return err
-	} else if ok {
-		defer checkoutRef(ref, "")
 	}
-	now := time.Now() // used to uniquely name artifact files
+	defer restore()
 	for _, bs := range bss {
-		if err := bs.build(pkgFilter, postChck, now); err != nil {
+		if err := bs.build(ctx, pkgFilter, bo); err != nil {
+			return err
+		}
+		if err := bs.createOutputFile(t); err != nil {
 			return err
 		}
 	}
 	return nil
 }
 
+// saveCheckout returns a function that switches back to the current branch,
+// if possible, once benchmark suites have been built. It is a no-op when
+// building in worktrees, which don't touch the current checkout.
+func saveCheckout(bo buildOpts) (func(), error) {
+	if !bo.worktree {
+		if ref, ok, err := getCurSymbolicRef(); err != nil {
+			return nil, err
+		} else if ok {
+			return func() { _ = checkoutRef(ref, "") }, nil
+		}
+	}
+	return func() {}, nil
+}
+
 func runCmpBenches(
 	ctx context.Context,
-	bs1, bs2 *benchSuite,
-	tests []string,
-	runPattern, benchTime string,
-	cpuProfile, memProfile, mutexProfile bool,
+	bss []*benchSuite,
+	targets []benchTarget,
+	benchTime string,
+	po profileOpts,
 	itersPerTest int,
+	rng *rand.Rand,
+	maxDuration time.Duration,
+	st *runState,
 ) error {
 	fmt.Fprintf(os.Stderr, "\nrunning benchmarks:")
 	var spinner ui.Spinner
 	spinner.Start(os.Stderr, "")
 	defer spinner.Stop()
-	for i, t := range tests {
-		pkg := testBinToPkg(t)
-		for j := 0; j < itersPerTest; j++ {
-			pkgFrac := ui.Fraction(i+1, len(tests))
-			iterFrac := ui.Fraction(j+1, itersPerTest)
-			progress := fmt.Sprintf(" pkg=%s iter=%s %s", pkgFrac, iterFrac, pkg)
-			spinner.Update(progress)
+	start := time.Now()
+	est := makeRunEstimator()
+	run := func(bs *benchSuite, t benchTarget, iter int) error {
+		if st.done(bs, t, iter) {
+			return nil
+		}
+		runStart := time.Now()
+		if err := runSingleBench(ctx, bs, t, iter, benchTime, po); err != nil {
+			return err
+		}
+		est.record(t, time.Since(runStart))
+		return st.record(bs, t, iter)
+	}
+	unit := "pkg"
+	if len(targets) > 0 && targets[0].name != "" {
+		unit = "bench"
+	}
+	if rng == nil && maxDuration == 0 {
+		for i, t := range targets {
+			for j := 0; j < itersPerTest; j++ {
+				var eta time.Duration
+				etaOK := true
+				for k, t := range targets[i:] {
+					runs := itersPerTest * len(bss)
+					if k == 0 {
+						runs = (itersPerTest - j) * len(bss)
+					}
+					d, ok := est.estimate(t, runs)
+					eta, etaOK = eta+d, etaOK && ok
+				}
+				unitFrac := ui.Fraction(i+1, len(targets))
+				iterFrac := ui.Fraction(j+1, itersPerTest)
+				progress := fmt.Sprintf(" %s=%s iter=%s%s %s",
+					unit, unitFrac, iterFrac, formatETA(eta, etaOK), t)
+				spinner.Update(progress)
 
-			// Interleave test suite runs instead of using -count=itersPerTest. The
-			// idea is that this reduces the chance that we pick up external noise
-			// with a time correlation.
-			if err := runSingleBench(bs1, t, runPattern, benchTime, cpuProfile, memProfile, mutexProfile); err != nil {
-				return err
+				// Interleave test suite runs instead of using -count=itersPerTest. The
+				// idea is that this reduces the chance that we pick up external noise
+				// with a time correlation.
+				for _, bs := range bss {
+					if err := run(bs, t, j); err != nil {
+						return err
+					}
+				}
 			}
-			if err := runSingleBench(bs2, t, runPattern, benchTime, cpuProfile, memProfile, mutexProfile); err != nil {
+			fmt.Fprintln(os.Stderr)
+		}
+		return nil
+	}
+
+	// Run each target once in each suite per round, in random order if
+	// shuffling, to also avoid a correlation between noise and the order of the
+	// targets. A maximum duration is only checked between rounds, so that every
+	// target gets the same number of samples.
+	type benchRun struct {
+		bs     *benchSuite
+		target benchTarget
+	}
+	runs := make([]benchRun, 0, len(targets)*len(bss))
+	for _, t := range targets {
+		for _, bs := range bss {
+			runs = append(runs, benchRun{bs: bs, target: t})
+		}
+	}
+	for j := 0; j < itersPerTest; j++ {
+		if maxDurationExceeded(start, maxDuration) {
+			return nil
+		}
+		if rng != nil {
+			rng.Shuffle(len(runs), func(a, b int) { runs[a], runs[b] = runs[b], runs[a] })
+		}
+		for k, r := range runs {
+			var eta time.Duration
+			etaOK := true
+			for _, t := range targets {
+				d, ok := est.estimate(t, (itersPerTest-j-1)*len(bss))
+				eta, etaOK = eta+d, etaOK && ok
+			}
+			for _, r := range runs[k:] {
+				d, ok := est.estimate(r.target, 1)
+				eta, etaOK = eta+d, etaOK && ok
+			}
+			roundFrac := ui.Fraction(j+1, itersPerTest)
+			runFrac := ui.Fraction(k+1, len(runs))
+			progress := fmt.Sprintf(" round=%s run=%s%s %s",
+				roundFrac, runFrac, formatETA(eta, etaOK), r.target)
+			spinner.Update(progress)
+			if err := run(r.bs, r.target, j); err != nil {
 				return err
 			}
 		}
@@ -345,41 +1097,154 @@ func runCmpBenches(
 	return nil
 }
 
+// runSingleBench runs the targeted benchmarks once, as the iter'th iteration
+// of the run, and writes the output to the suite's output file. If one of the
+// benchmarks hangs, it is recorded as timed out and the benchmarks after it
+// are run on their own.
 func runSingleBench(
-	bs *benchSuite, test, runPattern, benchTime string, cpuProfile, memProfile, mutexProfile bool,
+	ctx context.Context,
+	bs *benchSuite,
+	target benchTarget,
+	iter int,
+	benchTime string,
+	po profileOpts,
+) error {
+	if bs.skipTimedOut(target) {
+		return nil
+	}
+	profFile := func(profType string) string {
+		return bs.getIterProfileFile(target, profType, iter)
+	}
+	err := runTestBinary(ctx, bs, target.test, target.pattern, benchTime, po, profFile, bs.outFile)
+	if fErr, ok := err.(*failureError); ok {
+		err = bs.retryFailures(ctx, target, iter, benchTime, fErr.failures)
+	}
+	if tErr, ok := err.(*timeoutError); ok {
+		if target.name != "" {
+			if tErr.benchmark == "" {
+				// The benchmark hung before printing its name.
+				tErr.benchmark = target.name
+			}
+			bs.recordTimeout(target, iter, tErr)
+			return nil
+		}
+		// Determine which of the benchmarks hung, and run those after it,
+		// which did not get to run in this iteration.
+		var rest []string
+		if tErr.benchmark, rest, err = bs.hungBenchmark(ctx, target, tErr); err != nil {
+			return err
+		}
+		bs.recordTimeout(target, iter, tErr)
+		if len(rest) == 0 {
+			return nil
+		}
+		return runSingleBench(ctx, bs, remainingTarget(target, rest), iter, benchTime, po)
+	}
+	return err
+}
+
+// runTestBinary runs the benchmarks in the test binary that match runPattern.
+// Each of the configured types of profiles is written to the file returned by
+// profFile, and the output of the test binary is written to out. If the context
+// is canceled, the test binary is killed and errInterrupted is returned. If the
+// test binary exceeds one of the suite's timeouts, it is killed and a
+// *timeoutError is returned. Benchmarks that timed out before are skipped, if
+// the test binary supports it. If any benchmarks fail, a *failureError naming
+// them is returned.
+func runTestBinary(
+	ctx context.Context,
+	bs *benchSuite,
+	test, runPattern, benchTime string,
+	po profileOpts,
+	profFile func(profType string) string,
+	out io.Writer,
 ) error {
 	bin := bs.getTestBinary(test)
+	for _, profType := range po.types {
+		if err := os.MkdirAll(filepath.Dir(profFile(profType)), 0744); err != nil {
+			return err
+		}
+	}
 
 	// Determine whether the binary has a --logtostderr flag. Use CombinedOutput
 	// and ignore the error because --help creates a failed error status. If there
 	// is a real error we'll hit it below.
-	cmd := exec.Command(bin, "--help")
-	out, _ := cmd.CombinedOutput()
-	hasLogToStderr := bytes.Contains(out, []byte("logtostderr"))
+	cmd := exec.CommandContext(ctx, bin, "--help")
+	help, _ := cmd.CombinedOutput()
+	hasLogToStderr := bytes.Contains(help, []byte("logtostderr"))
+	hasSkip := bytes.Contains(help, []byte("test.skip"))
 
 	// Run the benchmark binary.
 	args := []string{bin, "-test.run", "-", "-test.bench", runPattern, "-test.benchmem"}
 	if benchTime != "" {
 		args = append(args, "-test.benchtime", benchTime)
 	}
-	if cpuProfile {
-		args = append(args, "-test.cpuprofile", bs.getCpuProfileFile())
-	}
-	if memProfile {
-		// TODO(nvanbenschoten): consider passing -test.memprofilerate=1.
-		args = append(args, "-test.memprofile", bs.getMemProfileFile())
-	}
-	if mutexProfile {
-		args = append(args, "-test.mutexprofile", bs.getMutexProfileFile())
-	}
+	args = append(args, po.args(profFile)...)
 	if hasLogToStderr {
 		args = append(args, "--logtostderr", "NONE")
 	}
-	if err := spawnWith(os.Stdin, bs.outFile, bs.outFile, args...); err != nil {
+	if skip := bs.timedOut(test); hasSkip && len(skip) > 0 {
+		args = append(args, "-test.skip", "^("+strings.Join(skip, "|")+")$")
+	}
+
+	// Kill the binary if it exceeds the invocation timeout or if it stops
+	// producing output for longer than the benchmark timeout.
+	var runCtx context.Context
+	var cancel context.CancelFunc
+	if bs.timeout.run > 0 {
+		runCtx, cancel = context.WithTimeout(ctx, bs.timeout.run)
+	} else {
+		runCtx, cancel = context.WithCancel(ctx)
+	}
+	defer cancel()
+	var output bytes.Buffer
+	wd := newHangWatchdog(io.MultiWriter(out, &output), bs.timeout.bench, cancel)
+	err := spawnWithContext(runCtx, "", os.Stdin, wd, wd, args...)
+	wd.stop()
+	if err != nil {
+		if ctx.Err() != nil {
+			return errInterrupted
+		}
+		if runCtx.Err() != nil {
+			// Terminate the partial line, so that it does not garble the
+			// output of the next run.
+			if len(wd.line) > 0 {
+				fmt.Fprintln(out)
+			}
+			procs := benchProcs(output.Bytes())
+			tErr := &timeoutError{
+				benchmark: wd.runningBenchmark(procs),
+				completed: lastCompletedBenchmark(output.Bytes(), procs),
+			}
+			if runCtx.Err() == context.DeadlineExceeded {
+				tErr.limit = bs.timeout.run
+			} else {
+				tErr.limit, tErr.perBench = bs.timeout.bench, true
+			}
+			name := tErr.benchmark
+			if name == "" {
+				name = testBinToPkg(test)
+			}
+			fmt.Fprintf(os.Stderr, "  %s %s\n", name, tErr)
+			return tErr
+		}
 		if exitErr, ok := err.(*exec.ExitError); ok {
+			if ws, ok := exitErr.Sys().(syscall.WaitStatus); ok && ws.Signaled() &&
+				(ws.Signal() == syscall.SIGINT || ws.Signal() == syscall.SIGTERM) {
+				// The signal was delivered to the whole process group.
+				return errInterrupted
+			}
 			if exitErr.ExitCode() == 1 {
 				// Assume exit code 1 corresponds to a benchmark failure.
-				fmt.Fprintln(os.Stderr, "  saw one or more benchmark failures")
+				failures := parseBenchFailures(output.Bytes())
+				if len(failures) == 0 {
+					fmt.Fprintln(os.Stderr, "  saw one or more benchmark failures")
+					return nil
+				}
+				for _, f := range failures {
+					fmt.Fprintf(os.Stderr, "  %s failed\n", f.Benchmark)
+				}
+				return &failureError{failures: failures}
 			} else {
 				return errors.Wrapf(err, "error running %v: %s", args, exitErr.Stderr)
 			}
@@ -390,33 +1255,42 @@ func runSingleBench(
 	return nil
 }
 
+// logPartialResults writes a comparison of the benchmark results collected
+// before benchdiff was interrupted to w.
+func logPartialResults(w io.Writer, bss []*benchSuite, st *runState) {
+	tables, err := collectBenchOutput(bss...)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "failed to collect partial results: %s\n", err)
+		return
+	}
+	if len(tables) == 0 {
+		return
+	}
+	fmt.Fprintf(w, "\npartial results (resume with --resume=%s):\n", st.Time)
+	logConfigLabels(w, bss)
+	benchstat.FormatText(w, tables)
+}
+
 func processBenchOutput(
 	ctx context.Context,
-	oldSuite, newSuite *benchSuite,
+	bss []*benchSuite,
 	out outputFmt,
 	pkgFilter []string,
 	srv *google.Service,
+	diffs []*profileDiff,
 ) ([]*benchstat.Table, error) {
-	// We're going to be reading the output files, so seek to the beginning.
-	oldSuite.outFile.Seek(0, io.SeekStart)
-	newSuite.outFile.Seek(0, io.SeekStart)
-
 	// Compute the benchmark comparison results.
-	var c benchstat.Collection
-	c.Alpha = 0.05
-	c.Order = benchstat.Reverse(benchstat.ByDelta) // best, first
-	if err := c.AddFile("old", oldSuite.outFile); err != nil {
-		return nil, err
-	}
-	if err := c.AddFile("new", newSuite.outFile); err != nil {
+	tables, err := collectBenchOutput(bss...)
+	if err != nil {
 		return nil, err
 	}
-	tables := c.Tables()
 
 	// Output the results.
 	switch out {
 	case text:
+		logConfigLabels(os.Stdout, bss)
 		benchstat.FormatText(os.Stdout, tables)
+		formatProfileDiffsText(os.Stdout, diffs)
 	case csv:
 		// If norange is true, suppress the range information for each data item.
 		// If norange is false, insert a "±" in the appropriate columns of the header row.
@@ -425,179 +1299,630 @@ func processBenchOutput(
 	case html:
 		var buf bytes.Buffer
 		benchstat.FormatHTML(&buf, tables)
+		if err := formatProfileDiffsHTML(&buf, diffs); err != nil {
+			return nil, err
+		}
 		io.Copy(os.Stdout, &buf)
 	case sheets:
 		// When outputting a Google sheet, also output as text first.
+		logConfigLabels(os.Stdout, bss)
 		benchstat.FormatText(os.Stdout, tables)
+		formatProfileDiffsText(os.Stdout, diffs)
 
-		sheetName := fmt.Sprintf("benchdiff: %s (%s -> %s)",
-			strings.Join(pkgFilter, " "), oldSuite.ref, newSuite.ref)
+		refs := make([]string, len(bss))
+		for i, bs := range bss {
+			// Prefer descriptive labels, like toolchain versions, over refs.
+			refs[i] = bs.ref
+			if bs.label != "old" && bs.label != "new" {
+				refs[i] = bs.label
+			}
+		}
+		sheetName := fmt.Sprintf("benchdiff: %s (%s)",
+			strings.Join(pkgFilter, " "), strings.Join(refs, " -> "))
 		url, err := srv.CreateSheet(ctx, sheetName, tables)
 		if err != nil {
 			return nil, err
 		}
 		fmt.Printf("\ngenerated sheet: %s\n", url)
+	case jsonFmt, markdown:
+		// The output includes the verdict of the regression threshold, so it is
+		// written once that has been checked.
 	default:
 		panic("unexpected")
 	}
 	return tables, nil
 }
 
-func logProfileLocations(
-	bs1, bs2 *benchSuite, cpuProfile, memProfile, mutexProfile bool,
-) {
-	log := func(profType string) {
-		fmt.Printf("\nwrote %s profiles to:\n  old=%s\n  new=%s\n",
-			profType, bs1.getProfileFile(profType), bs2.getProfileFile(profType))
+// logConfigLabels prints the labels of the old and new benchmark suites if
+// they are not labeled "old" and "new", because benchstat's text format always
+// names the two configurations of an old/new comparison "old" and "new".
+func logConfigLabels(w io.Writer, bss []*benchSuite) {
+	if len(bss) != 2 || (bss[0].label == "old" && bss[1].label == "new") {
+		return
 	}
-	if cpuProfile {
-		log("cpu")
+	fmt.Fprintf(w, "old: %s\nnew: %s\n\n", bss[0].label, bss[1].label)
+}
+
+// collectBenchOutput computes the benchstat comparison tables for the output
+// of the provided benchmark suites.
+func collectBenchOutput(bss ...*benchSuite) ([]*benchstat.Table, error) {
+	var c benchstat.Collection
+	c.Alpha = significanceLevel
+	// Don't mix up benchmarks with the same name in different packages.
+	c.SplitBy = []string{"pkg"}
+	c.Order = byPackage(benchstat.Reverse(benchstat.ByDelta)) // best, first
+	// Exclude benchmarks that failed persistently in any of the suites.
+	quarantined := make(map[benchKey]struct{})
+	for _, bs := range bss {
+		for _, f := range bs.quarantined {
+			quarantined[benchKey{test: f.Test, name: f.Benchmark}] = struct{}{}
+		}
 	}
-	if memProfile {
-		log("mem")
+	for _, bs := range bss {
+		data, err := bs.readOutput()
+		if err != nil {
+			return nil, err
+		}
+		c.AddConfig(bs.label, filterQuarantined(data, quarantined))
+	}
+	return c.Tables(), nil
+}
+
+// byPackage returns an order that keeps the rows of each package together, in
+// the order that the packages were benchmarked, and sorts the rows within each
+// package by the provided order. benchstat's formatters print the package
+// whenever it changes from one row to the next.
+func byPackage(order benchstat.Order) benchstat.Order {
+	groupIdx := func(t *benchstat.Table, group string) int {
+		for i, g := range t.Groups {
+			if g == group {
+				return i
+			}
+		}
+		return -1
+	}
+	return func(t *benchstat.Table, i, j int) bool {
+		gi, gj := groupIdx(t, t.Rows[i].Group), groupIdx(t, t.Rows[j].Group)
+		if gi != gj {
+			return gi < gj
+		}
+		return order(t, i, j)
+	}
+}
+
+// rowPackage returns the import path of the package of the benchmark in the
+// table's row, or an empty string if the benchmark output did not name it.
+// benchstat only sets the group of each row if the table has several groups.
+func rowPackage(table *benchstat.Table, row *benchstat.Row) string {
+	group := row.Group
+	if group == "" && len(table.Groups) == 1 {
+		group = table.Groups[0]
+	}
+	return strings.TrimPrefix(group, "pkg:")
+}
+
+// rowTestBin returns the name of the test binary of the benchmark in the
+// table's row, or an empty string if the benchmark output did not name its
+// package.
+func rowTestBin(table *benchstat.Table, row *benchstat.Row) string {
+	if pkg := rowPackage(table, row); pkg != "" {
+		return pkgToTestBin(pkg)
 	}
-	if mutexProfile {
-		log("mutex")
+	return ""
+}
+
+// logProfileLocations logs the location of the merged profiles of each suite.
+// The per-package profiles that they were merged from are written to the
+// same directory. Profiles that cannot be merged, like execution traces, are
+// logged as the patterns matching the files of each invocation of the test
+// binaries.
+func logProfileLocations(w io.Writer, bss []*benchSuite, profTypes []string) {
+	for _, profType := range profTypes {
+		pt := lookupProfileType(profType)
+		fmt.Fprintf(w, "\nwrote %s profiles to:\n", profType)
+		for _, bs := range bss {
+			f := bs.getProfileFile(profType)
+			if !pt.pprof {
+				var found []string
+				for _, pattern := range invocationProfilePatterns(filepath.Join(bs.profDir, "*"), profType) {
+					if matches, _ := filepath.Glob(pattern); len(matches) > 0 {
+						found = append(found, pattern)
+					}
+				}
+				f = strings.Join(found, " ")
+			} else if !bs.hasProfile(profType) {
+				f = ""
+			}
+			if f == "" {
+				f = "(none collected)"
+			}
+			fmt.Fprintf(w, "  %s=%s\n", bs.label, f)
+		}
 	}
 }
 
+// checkPassing returns a *regressionError listing every row of the comparison
+// tables that regressed by more than the threshold, if any.
 func checkPassing(thresh float64, tables []*benchstat.Table) error {
 	if thresh < 0 {
 		return nil
 	}
+	return newRegressionError(thresh, findRegressions(thresh, tables))
+}
+
+// regression is a row of a comparison table that regressed by more than the
+// threshold.
+type regression struct {
+	table *benchstat.Table
+	row   *benchstat.Row
+	// comparison names the compared refs, e.g. "a -> b", when comparing more
+	// than two suites.
+	comparison string
+}
+
+// regressionError is returned when one or more benchmarks regressed by more
+// than the threshold. It is the only error that makes benchdiff exit with
+// code 1.
+type regressionError struct {
+	thresh float64
+	regs   []regression // worst first
+}
+
+// newRegressionError returns a *regressionError for the regressions, sorted
+// by the magnitude of their change, or nil if there are none.
+func newRegressionError(thresh float64, regs []regression) error {
+	if len(regs) == 0 {
+		return nil
+	}
+	sort.SliceStable(regs, func(i, j int) bool {
+		return math.Abs(regs[i].row.PctDelta) > math.Abs(regs[j].row.PctDelta)
+	})
+	return &regressionError{thresh: thresh, regs: regs}
+}
+
+func (e *regressionError) Error() string {
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "%d regression(s) exceeded threshold of %.2f%%:", len(e.regs), e.thresh*100)
+	for _, r := range e.regs {
+		fmt.Fprintf(&buf, "\n  %s", r)
+	}
+	return buf.String()
+}
+
+// String implements fmt.Stringer.
+func (r regression) String() string {
+	name := r.row.Benchmark
+	if pkg := rowPackage(r.table, r.row); pkg != "" {
+		name = pkg + " " + name
+	}
+	s := fmt.Sprintf("%s regression in %s of %s", r.table.Metric, name, r.row.Delta)
+	if r.comparison != "" {
+		s += " (" + r.comparison + ")"
+	}
+	return s
+}
+
+// findRegressions returns the rows of the comparison tables that regressed by
+// more than the threshold.
+func findRegressions(thresh float64, tables []*benchstat.Table) []regression {
+	var regs []regression
 	threshPct := thresh * 100
 	for _, table := range tables {
 		for _, row := range table.Rows {
 			worse := row.Change == -1
 			exceededThresh := math.Abs(row.PctDelta) > threshPct
 			if worse && exceededThresh {
-				return errors.Errorf("%s regression in %s of %s exceeded threshold of %.2f%%",
-					table.Metric, row.Benchmark, row.Delta, threshPct)
+				regs = append(regs, regression{table: table, row: row})
 			}
 		}
 	}
-	return nil
+	return regs
 }
 
 type benchSuite struct {
-	ref       string
-	artDir    string
-	outFile   *os.File
-	binDir    string
-	testFiles fileSet
+	ref      string
+	id       string // unique name of the suite, used for its artifacts directory
+	label    string // name of the suite's configuration in benchstat output
+	cfg      buildConfig
+	srcDir   string // empty for the current working directory
+	artDir   string
+	profDir  string // directory of the profiles of the current run
+	outFile  *os.File
+	timeout  timeoutOpts
+	timeouts []benchTimeout // runs of the current run that timed out
+	retries  int            // number of times to retry failed benchmarks
+	// quarantined holds the benchmarks of the current run that failed on
+	// every attempt, which are excluded from the comparison.
+	quarantined []benchFailure
+	testBins    map[string]string // test binary name -> path
+	// buildFailures holds the packages that failed to build, if building with
+	// --keep-going.
+	buildFailures buildFailures
 }
 type fileSet map[string]struct{}
 
-func makeBenchSuite(ref string) benchSuite {
+func makeBenchSuite(ref, label string, cfg buildConfig) benchSuite {
+	// Suites with a non-default build configuration are stored separately, so
+	// that the same ref can be compared under multiple configurations.
+	id := ref
+	if !cfg.empty() {
+		id = ref + "." + hash([]string{cfg.String()})
+	}
 	return benchSuite{
-		ref:       ref,
-		testFiles: make(fileSet),
+		ref:      ref,
+		id:       id,
+		label:    label,
+		cfg:      cfg,
+		testBins: make(map[string]string),
 	}
 }
 
-func (bs *benchSuite) build(pkgFilter []string, postChck string, t time.Time) (err error) {
-	if len(bs.testFiles) != 0 {
+func (bs *benchSuite) build(ctx context.Context, pkgFilter []string, bo buildOpts) error {
+	if len(bs.testBins) != 0 {
 		panic("benchSuite already built")
 	}
 
-	// Create the artifacts directory: ./benchdiff/<ref>/artifacts
-	bs.artDir = testArtifactsDir(bs.ref)
-	if err = os.MkdirAll(bs.artDir, 0744); err != nil {
+	// Create the artifacts directory: ./benchdiff/<id>/artifacts
+	bs.artDir = testArtifactsDir(bs.id)
+	if err := os.MkdirAll(bs.artDir, 0744); err != nil {
+		return err
+	}
+
+	// Determine the build configuration, which is part of each cache key.
+	goVersion, err := getGoVersion(bs.cfg)
+	if err != nil {
+		return err
+	}
+	fileSalt, err := bs.cfg.fileSalt()
+	if err != nil {
+		return err
+	}
+	buildSalt := append([]string{goVersion, bo.postChck, bs.cfg.String()}, fileSalt...)
+
+	// Look for an index of cached test binaries for this ref and package
+	// filter: ./benchdiff/<ref>/bin/<hash(pkgFilter,buildSalt)>.json. If all
+	// of the cached binaries are still valid, we don't need to check out the
+	// ref at all. The working tree's contents change between runs, so never
+	// reuse its test binaries.
+	indexFile := testBinIndexFile(bs.ref, pkgFilter, buildSalt)
+	if bs.ref != worktreeRef {
+		if idx, ok := readCacheIndex(indexFile); ok && bs.installCached(idx) {
+			fmt.Fprintf(os.Stderr, "test binaries already exist for '%s'; skipping build\n", bs.ref)
+			return nil
+		}
+	}
+
+	if bs.ref == worktreeRef {
+		// Build directly from the current working directory.
+		fmt.Fprintf(os.Stderr, "using uncommitted changes in working tree\n")
+	} else if bo.worktree {
+		// Build from benchdiff's worktree: ./benchdiff/.worktree
+		bs.srcDir = testWorktreeDir()
+		fmt.Fprintf(os.Stderr, "checking out '%s' in worktree %s\n", bs.ref, bs.srcDir)
+		if err := checkoutWorktree(bs.srcDir, bs.ref, bo.postChck); err != nil {
+			return err
+		}
+	} else {
+		fmt.Fprintf(os.Stderr, "checking out '%s'\n", bs.ref)
+		if err := checkoutRef(bs.ref, bo.postChck); err != nil {
+			return err
+		}
+	}
+
+	// Determine which packages to build.
+	pkgs, listFailures, err := expandPackages(bs.srcDir, pkgFilter, bs.cfg)
+	if err != nil {
+		return err
+	}
+	if err := bs.handleBuildFailures(listFailures, bo.keepGoing); err != nil {
+		return err
+	}
+
+	if bs.ref == worktreeRef {
+		return bs.buildUncached(ctx, pkgs, testBinDir(bs.id, pkgFilter), bo.jobs, bo.keepGoing)
+	}
+	// Cache keys are derived from the ref's tree, so they only describe the
+	// test binaries if nothing in the checkout differs from it, including
+	// files generated by the post-checkout command.
+	if clean, err := isCleanCheckout(bs.srcDir); err != nil {
 		return err
+	} else if !clean {
+		fmt.Fprintf(os.Stderr, "checkout of '%s' has uncommitted changes; not caching its test binaries\n", bs.ref)
+		return bs.buildUncached(ctx, pkgs, testBinDir(bs.id, pkgFilter), bo.jobs, bo.keepGoing)
 	}
 
-	// Create output file: ./benchdiff/<ref>/artifacts/out.<time>
-	outFileName := bs.getOutputFile(t)
-	bs.outFile, err = os.OpenFile(outFileName, os.O_RDWR|os.O_CREATE, 0644)
+	// Determine the cache key of each package's test binary.
+	keys, err := computeCacheKeys(bs.srcDir, bs.ref, pkgs, bs.cfg, buildSalt)
 	if err != nil {
 		return err
 	}
+	var toBuild []string
+	for _, pkg := range pkgs {
+		key, ok := keys[pkg]
+		if !ok {
+			// No test files.
+			continue
+		}
+		if m, ok := lookupCacheEntry(key); ok {
+			bs.addCached(m)
+		} else {
+			toBuild = append(toBuild, pkg)
+		}
+	}
+	if cached := len(keys) - len(toBuild); cached > 0 {
+		fmt.Fprintf(os.Stderr, "found %d/%d test binaries for '%s' in cache\n", cached, len(keys), bs.ref)
+	}
 
-	// Create the binary directory: ./benchdiff/<ref>/bin/<hash(pkgFilter)>
-	bs.binDir = testBinDir(bs.ref, pkgFilter)
-	if _, err = os.Stat(bs.binDir); err == nil {
-		fmt.Fprintf(os.Stderr, "test binaries already exist for '%s'; skipping build\n", bs.ref)
-		files, err := ioutil.ReadDir(bs.binDir)
+	var mu sync.Mutex
+	failures, err := bs.buildPkgs(ctx, toBuild, bo.jobs, func(pkg string) error {
+		m, err := buildCacheEntry(ctx, bs.srcDir, pkg, bs.ref, keys[pkg], bs.cfg)
 		if err != nil {
 			return err
 		}
-		for _, f := range files {
-			if f.IsDir() {
-				return errors.Errorf("unexpected directory %q", f.Name())
-			}
-			bs.testFiles[f.Name()] = struct{}{}
-		}
+		mu.Lock()
+		defer mu.Unlock()
+		bs.addCached(m)
 		return nil
-	} else if !os.IsNotExist(err) {
-		return errors.Wrap(err, "looking for test directory")
+	})
+	if err != nil {
+		return err
+	}
+	if len(failures) > 0 || len(listFailures) > 0 {
+		// Don't write the index, so that the failed packages are retried
+		// the next time this ref is built.
+		return bs.handleBuildFailures(failures, bo.keepGoing)
+	}
+	return writeCacheIndex(indexFile, cacheIndex{Keys: keys})
+}
+
+// buildUncached builds test binaries for the specified packages into the
+// provided directory, bypassing the test binary cache.
+func (bs *benchSuite) buildUncached(
+	ctx context.Context, pkgs []string, binDir string, jobs int, keepGoing bool,
+) (err error) {
+	if err := os.RemoveAll(binDir); err != nil {
+		return err
 	}
-	if err := os.MkdirAll(bs.binDir, 0700); err != nil {
+	if err := os.MkdirAll(binDir, 0700); err != nil {
 		return err
 	}
 	// If the binaries are not generated successfully, delete the bin directory
-	// so we don't consider the build successful next time benchdiff runs.
+	// so that it is not mistaken for a successful build.
 	defer func() {
 		if err != nil {
-			_ = os.RemoveAll(bs.binDir)
+			_ = os.RemoveAll(binDir)
 		}
 	}()
 
-	fmt.Fprintf(os.Stderr, "checking out '%s'\n", bs.ref)
-	if err := checkoutRef(bs.ref, postChck); err != nil {
+	var mu sync.Mutex
+	failures, err := bs.buildPkgs(ctx, pkgs, jobs, func(pkg string) error {
+		testBin, ok, err := buildTestBin(ctx, bs.srcDir, pkg, binDir, bs.cfg)
+		if err != nil {
+			return err
+		}
+		if ok {
+			mu.Lock()
+			defer mu.Unlock()
+			bs.testBins[testBin] = filepath.Join(binDir, testBin)
+		}
+		return nil
+	})
+	if err != nil {
 		return err
 	}
+	return bs.handleBuildFailures(failures, keepGoing)
+}
 
-	// Determine which packages to build.
-	pkgs, err := expandPackages(pkgFilter)
-	if err != nil {
-		return err
+// handleBuildFailures records the build failures in the benchSuite, along with
+// any recorded before, if keepGoing is set. Otherwise, it returns an error
+// describing them.
+func (bs *benchSuite) handleBuildFailures(failures buildFailures, keepGoing bool) error {
+	if !keepGoing {
+		return failures.asError(bs.ref)
+	}
+	if len(failures) == 0 {
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "failed to build %d package(s) for '%s'; skipping\n", len(failures), bs.ref)
+	if bs.buildFailures == nil {
+		bs.buildFailures = make(buildFailures)
 	}
+	for pkg, err := range failures {
+		bs.buildFailures[pkg] = err
+	}
+	return nil
+}
 
+// buildPkgs calls build for each of the specified packages, running up to jobs
+// builds concurrently, and displays the progress of the builds. It returns the
+// build failure of each package that failed to build. If the context is
+// canceled, no more builds are started and errInterrupted is returned.
+func (bs *benchSuite) buildPkgs(
+	ctx context.Context, pkgs []string, jobs int, build func(pkg string) error,
+) (buildFailures, error) {
+	if len(pkgs) == 0 {
+		return nil, nil
+	}
 	var spinner ui.Spinner
 	spinner.Start(os.Stderr, fmt.Sprintf("building benchmark binaries for '%s'", bs.ref))
 	defer spinner.Stop()
-	for i, pkg := range pkgs {
-		spinner.Update(ui.Fraction(i, len(pkgs)))
-		if testBin, ok, err := buildTestBin(pkg, bs.binDir); err != nil {
-			return err
-		} else if ok {
-			bs.testFiles[testBin] = struct{}{}
+	spinner.Update(ui.Fraction(0, len(pkgs)))
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	var done int
+	failures := make(buildFailures)
+	sem := make(chan struct{}, jobs)
+	for _, pkg := range pkgs {
+		pkg := pkg
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
 		}
+		if ctx.Err() != nil {
+			break
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-sem }()
+			err := build(pkg)
+
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				failures[pkg] = err
+			}
+			done++
+			spinner.Update(ui.Fraction(done, len(pkgs)))
+		}()
+	}
+	wg.Wait()
+	if ctx.Err() != nil {
+		return nil, errInterrupted
+	}
+	return failures, nil
+}
+
+// buildFailures maps each package that failed to build to its build error.
+type buildFailures map[string]error
+
+// asError returns an error describing all build failures, or nil if there
+// were none.
+func (bf buildFailures) asError(ref string) error {
+	if len(bf) == 0 {
+		return nil
+	}
+	pkgs := make([]string, 0, len(bf))
+	for pkg := range bf {
+		pkgs = append(pkgs, pkg)
+	}
+	sort.Strings(pkgs)
+	var buf strings.Builder
+	fmt.Fprintf(&buf, "failed to build %d package(s) for '%s':", len(bf), ref)
+	for _, pkg := range pkgs {
+		msg := strings.ReplaceAll(bf[pkg].Error(), "\n", "\n    ")
+		fmt.Fprintf(&buf, "\n  %s: %s", pkg, msg)
+	}
+	return errors.New(buf.String())
+}
+
+// installCached installs the cached test binaries referenced by the index into
+// the benchSuite. It returns false, without installing any binaries, if any
+// of the cache entries are missing or invalid.
+func (bs *benchSuite) installCached(idx cacheIndex) bool {
+	ms := make([]cacheManifest, 0, len(idx.Keys))
+	for _, key := range idx.Keys {
+		m, ok := lookupCacheEntry(key)
+		if !ok {
+			return false
+		}
+		ms = append(ms, m)
+	}
+	for _, m := range ms {
+		bs.addCached(m)
+	}
+	return true
+}
+
+// addCached adds the test binary in the cache entry to the benchSuite.
+func (bs *benchSuite) addCached(m cacheManifest) {
+	if p, ok := m.testBinPath(); ok {
+		bs.testBins[m.TestBin] = p
 	}
-	spinner.Update(ui.Fraction(len(pkgs), len(pkgs)))
-	return nil
+}
+
+// createOutputFile creates the file that benchmark output for the run at the
+// specified time is written to: ./benchdiff/<id>/artifacts/out.<time>. Profiles
+// for the run are written to ./benchdiff/<id>/artifacts/profiles.<time>.
+func (bs *benchSuite) createOutputFile(t time.Time) (err error) {
+	bs.setProfileDir(t)
+	bs.outFile, err = os.OpenFile(bs.getOutputFile(t), os.O_RDWR|os.O_CREATE, 0644)
+	return err
 }
 
 func (bs *benchSuite) close() {
 	_ = bs.outFile.Close()
 }
 
-func (bs *benchSuite) getOutputFile(t time.Time) string {
-	return filepath.Join(bs.artDir, "out."+t.Format(timeFormat))
+// readOutput reads the suite's output file, leaving its offset at the end of
+// the file.
+func (bs *benchSuite) readOutput() ([]byte, error) {
+	if _, err := bs.outFile.Seek(0, io.SeekStart); err != nil {
+		return nil, err
+	}
+	return ioutil.ReadAll(bs.outFile)
 }
 
-func (bs *benchSuite) getCpuProfileFile() string   { return bs.getProfileFile("cpu") }
-func (bs *benchSuite) getMemProfileFile() string   { return bs.getProfileFile("mem") }
-func (bs *benchSuite) getMutexProfileFile() string { return bs.getProfileFile("mutex") }
-
-func (bs *benchSuite) getProfileFile(profType string) string {
-	return filepath.Join(bs.artDir, profType+".prof")
+func (bs *benchSuite) getOutputFile(t time.Time) string {
+	return filepath.Join(bs.artDir, "out."+t.Format(timeFormat))
 }
 
 func (bs *benchSuite) getTestBinary(bin string) string {
-	return filepath.Join(bs.binDir, bin)
+	return bs.testBins[bin]
 }
 
-func (bs *benchSuite) intersectTests(bs2 *benchSuite) fileSet {
+// intersectTests returns the set of test binaries present in all of the
+// provided benchmark suites.
+func intersectTests(bss []*benchSuite) fileSet {
 	intersect := make(fileSet)
-	for f := range bs.testFiles {
-		if _, ok := bs2.testFiles[f]; ok {
-			intersect[f] = struct{}{}
+	for f := range bss[0].testBins {
+		intersect[f] = struct{}{}
+	}
+	for _, bs := range bss[1:] {
+		for f := range intersect {
+			if _, ok := bs.testBins[f]; !ok {
+				delete(intersect, f)
+			}
 		}
 	}
 	return intersect
 }
 
+// logSkippedTests prints a summary of the test binaries that were not
+// benchmarked because they were missing from one or more of the benchmark
+// suites, along with the reason that each was missing.
+func logSkippedTests(bss []*benchSuite, tests fileSet) {
+	// Collect every test binary that any suite built or tried to build.
+	all := make(fileSet)
+	for _, bs := range bss {
+		for f := range bs.testBins {
+			all[f] = struct{}{}
+		}
+		for pkg := range bs.buildFailures {
+			all[pkgToTestBin(pkg)] = struct{}{}
+		}
+	}
+	if len(all) == len(tests) {
+		return
+	}
+
+	fmt.Fprintf(os.Stderr, "\nskipped %d package(s):\n", len(all)-len(tests))
+	for _, bs := range bss {
+		failed := make(map[string]error, len(bs.buildFailures))
+		for pkg, err := range bs.buildFailures {
+			failed[pkgToTestBin(pkg)] = err
+		}
+		var skipped []string
+		for _, f := range all.sorted() {
+			if _, ok := tests[f]; ok {
+				continue
+			}
+			if _, ok := bs.testBins[f]; ok {
+				continue
+			}
+			reason := "no test binary"
+			if err, ok := failed[f]; ok {
+				reason = "failed to build: " + strings.ReplaceAll(err.Error(), "\n", "\n      ")
+			}
+			skipped = append(skipped, fmt.Sprintf("    %s: %s", testBinToPkg(f), reason))
+		}
+		if len(skipped) > 0 {
+			fmt.Fprintf(os.Stderr, "  %s ('%s'):\n%s\n", bs.label, bs.ref, strings.Join(skipped, "\n"))
+		}
+	}
+}
+
 func (fs fileSet) sorted() []string {
 	s := make([]string, 0, len(fs))
 	for t := range fs {
@@ -0,0 +1,144 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"golang.org/x/perf/benchstat"
+)
+
+// Indicators that mark the rows of significant changes in markdown tables.
+const (
+	regressionIndicator  = "🔴"
+	improvementIndicator = "🟢"
+)
+
+// formatMarkdown writes the comparison tables of each suite against the
+// baseline as GitHub-flavored markdown, suitable for pull request comments. A
+// summary header describes the run and whether it met the regression
+// threshold. Rows without a significant change are collapsed into a <details>
+// block below each table.
+func formatMarkdown(
+	w io.Writer,
+	bss []*benchSuite,
+	pkgFilter []string,
+	itersPerTest int,
+	threshold float64,
+	cmpTables [][]*benchstat.Table,
+	verdict error,
+) {
+	fmt.Fprintf(w, "### benchdiff\n\n")
+	commits := make([]string, len(bss))
+	for i, bs := range bss {
+		commits[i] = fmt.Sprintf("`%s` (%s)", bs.ref, bs.label)
+	}
+	fmt.Fprintf(w, "- **Commits:** %s\n", strings.Join(commits, " → "))
+	pkgs := make([]string, len(pkgFilter))
+	for i, pkg := range pkgFilter {
+		pkgs[i] = "`" + pkg + "`"
+	}
+	fmt.Fprintf(w, "- **Packages:** %s\n", strings.Join(pkgs, " "))
+	fmt.Fprintf(w, "- **Count:** %d\n", itersPerTest)
+	if threshold >= 0 {
+		if verdict == nil {
+			fmt.Fprintf(w, "- **Threshold:** ✅ no regression exceeded %.2f%%\n", threshold*100)
+		} else if rErr, ok := verdict.(*regressionError); ok {
+			fmt.Fprintf(w, "- **Threshold:** ❌ %d regression(s) exceeded %.2f%%\n", len(rErr.regs), threshold*100)
+			for _, r := range rErr.regs {
+				fmt.Fprintf(w, "  - %s %s\n", regressionIndicator, markdownEscape(r.String()))
+			}
+		} else {
+			fmt.Fprintf(w, "- **Threshold:** ❌ %s\n", markdownEscape(verdict.Error()))
+		}
+	}
+
+	for i, tables := range cmpTables {
+		for _, table := range tables {
+			if len(cmpTables) > 1 {
+				fmt.Fprintf(w, "\n#### %s: %s → %s\n\n", table.Metric, bss[0].label, bss[i+1].label)
+			} else {
+				fmt.Fprintf(w, "\n#### %s\n\n", table.Metric)
+			}
+			var changed, unchanged []*benchstat.Row
+			for _, row := range table.Rows {
+				if table.OldNewDelta && row.Change == 0 {
+					unchanged = append(unchanged, row)
+				} else {
+					changed = append(changed, row)
+				}
+			}
+			if len(changed) > 0 {
+				formatMarkdownTable(w, table, changed)
+			} else {
+				fmt.Fprintf(w, "No significant changes.\n")
+			}
+			if len(unchanged) > 0 {
+				fmt.Fprintf(w, "\n<details><summary>%d unchanged</summary>\n\n", len(unchanged))
+				formatMarkdownTable(w, table, unchanged)
+				fmt.Fprintf(w, "\n</details>\n")
+			}
+		}
+	}
+}
+
+// formatMarkdownTable writes the specified rows of the table as a markdown
+// table. If the table has benchmarks from several packages, the package of
+// each row is listed in its own column.
+func formatMarkdownTable(w io.Writer, table *benchstat.Table, rows []*benchstat.Row) {
+	pkgs := len(table.Groups) > 1
+	var header, align []string
+	if pkgs {
+		header, align = append(header, "package"), append(align, "---")
+	}
+	header = append(append(header, "name"), table.Configs...)
+	align = append(align, "---")
+	for range table.Configs {
+		align = append(align, "---:")
+	}
+	if table.OldNewDelta {
+		header = append(header, "delta", "")
+		align = append(align, "---:", "---")
+	}
+	fmt.Fprintf(w, "| %s |\n", strings.Join(header, " | "))
+	fmt.Fprintf(w, "| %s |\n", strings.Join(align, " | "))
+	for _, row := range rows {
+		var cols []string
+		if pkgs {
+			cols = append(cols, "`"+rowPackage(table, row)+"`")
+		}
+		cols = append(cols, markdownEscape(row.Benchmark))
+		for _, m := range row.Metrics {
+			cols = append(cols, formatMarkdownMetrics(m, row.Scaler))
+		}
+		if table.OldNewDelta {
+			delta := row.Delta
+			switch row.Change {
+			case -1:
+				delta = regressionIndicator + " " + delta
+			case +1:
+				delta = improvementIndicator + " " + delta
+			}
+			cols = append(cols, delta, row.Note)
+		}
+		fmt.Fprintf(w, "| %s |\n", strings.Join(cols, " | "))
+	}
+}
+
+// formatMarkdownMetrics formats the mean and the largest deviation from it.
+func formatMarkdownMetrics(m *benchstat.Metrics, scaler benchstat.Scaler) string {
+	if m.Unit == "" {
+		return ""
+	}
+	s := m.FormatMean(scaler)
+	if diff := m.FormatDiff(); diff != "" {
+		s += " ± " + diff
+	}
+	return s
+}
+
+// markdownEscape escapes the characters in s that would otherwise be
+// interpreted as markdown table syntax or emphasis.
+func markdownEscape(s string) string {
+	return strings.NewReplacer("|", `\|`, "*", `\*`, "_", `\_`).Replace(s)
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// pgoAuto is the value of the --pgo flag that instructs benchdiff to generate
+// the profile used for profile-guided optimization from the CPU profiles of a
+// previous run.
+const pgoAuto = "auto"
+
+// pgoConfigs returns the build configurations and labels of the baseline and
+// the profile-guided benchmark suites for the specified ref. The baseline is
+// built with PGO disabled and the other is built with the provided profile,
+// or, if the profile is pgoAuto, with the profile returned by autoPGOProfile
+// for runs before the specified time.
+func pgoConfigs(
+	ref string, cfg buildConfig, profile string, before time.Time,
+) (cfgs []buildConfig, labels []string, err error) {
+	off := cfg
+	off.flags = append(append([]string(nil), cfg.flags...), "-pgo=off")
+	if profile == pgoAuto {
+		if profile, err = autoPGOProfile(ref, []buildConfig{cfg, off}, before); err != nil {
+			return nil, nil, err
+		}
+	} else if _, err := os.Stat(profile); err != nil {
+		return nil, nil, errors.Wrap(err, "looking for PGO profile")
+	}
+	// The toolchain runs in the source directory, so make the path absolute.
+	if profile, err = filepath.Abs(profile); err != nil {
+		return nil, nil, err
+	}
+	on := cfg
+	on.flags = append(append([]string(nil), cfg.flags...), "-pgo="+profile)
+	return []buildConfig{off, on}, []string{"pgo=off", "pgo=" + filepath.Base(profile)}, nil
+}
+
+// pgoProfileFile returns the file that a generated PGO profile is written to,
+// given the profile directory of the run that it is generated from.
+func pgoProfileFile(profDir string) string {
+	return filepath.Join(profDir, "default.pgo")
+}
+
+// autoPGOProfile returns the profile used for profile-guided optimization of
+// the specified ref with --pgo=auto. It is merged from the CPU profiles of the
+// latest run before the specified time that recorded them for the ref under
+// any of the provided build configurations, which should not enable PGO. The
+// profile is written to the profile directory of that run and reused by later
+// runs, so that the build configuration of the profile-guided suite, and with
+// it the location of its artifacts, does not change.
+func autoPGOProfile(ref string, cfgs []buildConfig, before time.Time) (string, error) {
+	type profRun struct {
+		dir string
+		t   time.Time
+	}
+	var runs []profRun
+	for _, cfg := range cfgs {
+		bs := makeBenchSuite(ref, "", cfg)
+		dirs, err := filepath.Glob(filepath.Join(testArtifactsDir(bs.id), "profiles.*"))
+		if err != nil {
+			return "", err
+		}
+		for _, dir := range dirs {
+			t, err := time.Parse(timeFormat, strings.TrimPrefix(filepath.Base(dir), "profiles."))
+			if err != nil || !t.Before(before) {
+				continue
+			}
+			runs = append(runs, profRun{dir: dir, t: t})
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].t.After(runs[j].t) })
+
+	for _, r := range runs {
+		dst := pgoProfileFile(r.dir)
+		if _, err := os.Stat(dst); err == nil {
+			fmt.Fprintf(os.Stderr, "using PGO profile %s\n", dst)
+			return dst, nil
+		}
+		profiles, err := cpuProfiles(r.dir)
+		if err != nil {
+			return "", err
+		}
+		if len(profiles) == 0 {
+			continue
+		}
+		if err := mergeProfiles(profiles, dst); err != nil {
+			return "", errors.Wrap(err, "generating PGO profile")
+		}
+		fmt.Fprintf(os.Stderr, "merged %d cpu profile(s) of the run at %s into PGO profile %s\n",
+			len(profiles), r.t.Format(timeFormat), dst)
+		return dst, nil
+	}
+	return "", errors.Errorf("--pgo=%s found no cpu profiles of '%s'; "+
+		"record them first with --cpuprofile, e.g. --new=%s --cpuprofile", pgoAuto, ref, ref)
+}
+
+// cpuProfiles returns the CPU profiles of the run with the specified profile
+// directory: the profile that they were merged into, if the run completed,
+// and otherwise the profiles of each invocation of each test binary.
+func cpuProfiles(profDir string) ([]string, error) {
+	merged := filepath.Join(profDir, "cpu.prof")
+	if _, err := os.Stat(merged); err == nil {
+		return []string{merged}, nil
+	}
+	var profiles []string
+	for _, pattern := range []string{"*/cpu.*.prof", "*/*/cpu.*.prof", "*/*/cpu.prof"} {
+		matches, err := filepath.Glob(filepath.Join(profDir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		profiles = append(profiles, matches...)
+	}
+	return nonEmptyFiles(profiles), nil
+}
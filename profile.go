@@ -0,0 +1,240 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/nvanbenschoten/benchdiff/ui"
+	"github.com/pkg/errors"
+)
+
+// profileType is a type of profile that test binaries can record.
+type profileType struct {
+	name     string // e.g. cpu
+	flag     string // benchdiff flag that enables the profile
+	testFlag string // test binary flag that records the profile
+	ext      string // file extension of the profile
+	// pprof is set for profiles in the pprof format, which can be merged and
+	// diffed. Other profiles, like execution traces, are only collected.
+	pprof bool
+}
+
+// profileTypes lists the types of profiles that benchdiff can record, in the
+// order in which they are reported.
+var profileTypes = []profileType{
+	{name: "cpu", flag: "cpuprofile", testFlag: "-test.cpuprofile", ext: ".prof", pprof: true},
+	{name: "mem", flag: "memprofile", testFlag: "-test.memprofile", ext: ".prof", pprof: true},
+	{name: "mutex", flag: "mutexprofile", testFlag: "-test.mutexprofile", ext: ".prof", pprof: true},
+	{name: "block", flag: "blockprofile", testFlag: "-test.blockprofile", ext: ".prof", pprof: true},
+	{name: "trace", flag: "trace", testFlag: "-test.trace", ext: ".out"},
+}
+
+// lookupProfileType returns the profile type with the specified name.
+func lookupProfileType(name string) profileType {
+	for _, pt := range profileTypes {
+		if pt.name == name {
+			return pt
+		}
+	}
+	panic(fmt.Sprintf("unknown profile type %q", name))
+}
+
+// pprofTypes returns the profile types in the pprof format.
+func pprofTypes(profTypes []string) []string {
+	var res []string
+	for _, name := range profTypes {
+		if lookupProfileType(name).pprof {
+			res = append(res, name)
+		}
+	}
+	return res
+}
+
+// profileOpts configures the profiles recorded by test binaries.
+type profileOpts struct {
+	types []string // names of the profile types to record
+	// memProfileRate, if non-zero, is passed to test binaries as
+	// -test.memprofilerate. A rate of 1 records every allocation.
+	memProfileRate int
+}
+
+// args returns the test binary flags that record the profiles, given the file
+// that each profile type is written to.
+func (po profileOpts) args(profFile func(profType string) string) []string {
+	var args []string
+	for _, name := range po.types {
+		args = append(args, lookupProfileType(name).testFlag, profFile(name))
+	}
+	if po.memProfileRate != 0 {
+		args = append(args, "-test.memprofilerate", strconv.Itoa(po.memProfileRate))
+	}
+	return args
+}
+
+// Profiles are written once per test binary invocation, which runs either all
+// benchmarks in the package or, with --interleave=bench or when profiling
+// benchmarks in isolation, a single benchmark. Profiles in the pprof format
+// are then merged, first per package and then per suite:
+//
+//   ./benchdiff/<id>/artifacts/profiles.<time>/<test>/<type>.<iter>.prof
+//   ./benchdiff/<id>/artifacts/profiles.<time>/<test>/<benchmark>/<type>.<iter>.prof
+//   ./benchdiff/<id>/artifacts/profiles.<time>/<test>/<benchmark>/<type>.prof
+//   ./benchdiff/<id>/artifacts/profiles.<time>/<test>/<type>.prof
+//   ./benchdiff/<id>/artifacts/profiles.<time>/<type>.prof
+
+// setProfileDir sets the directory that profiles for the run at the specified
+// time are written to.
+func (bs *benchSuite) setProfileDir(t time.Time) {
+	bs.profDir = filepath.Join(bs.artDir, "profiles."+t.Format(timeFormat))
+}
+
+// getIterProfileFile returns the file that the profile of the specified type
+// is written to by the iter'th run of the targeted benchmarks.
+func (bs *benchSuite) getIterProfileFile(target benchTarget, profType string, iter int) string {
+	dir := filepath.Join(bs.profDir, target.test)
+	if target.name != "" {
+		dir = filepath.Join(dir, target.dir())
+	}
+	ext := lookupProfileType(profType).ext
+	return filepath.Join(dir, profType+"."+strconv.Itoa(iter)+ext)
+}
+
+// getPkgProfileFile returns the file that the profiles of the specified type
+// from all invocations of the test binary are merged into.
+func (bs *benchSuite) getPkgProfileFile(test, profType string) string {
+	return filepath.Join(bs.profDir, test, profType+".prof")
+}
+
+// getProfileFile returns the file that the profiles of the specified type from
+// all packages are merged into.
+func (bs *benchSuite) getProfileFile(profType string) string {
+	return filepath.Join(bs.profDir, profType+".prof")
+}
+
+// invocationProfilePatterns returns the glob patterns that match the profiles
+// of the specified type written by each invocation of a test binary, given
+// the test binary's profile directory. They follow the layout of
+// getIterProfileFile and profileBenchTarget.
+func invocationProfilePatterns(testDir, profType string) []string {
+	ext := lookupProfileType(profType).ext
+	return []string{
+		filepath.Join(testDir, profType+".*"+ext),
+		filepath.Join(testDir, "*", profType+".*"+ext),
+		filepath.Join(testDir, "*", profType+ext),
+	}
+}
+
+// mergeProfiles merges the per-invocation and per-benchmark profiles of the
+// specified type into a profile per package and then into a profile for the
+// whole suite. Packages without any profiles, for instance because no
+// benchmarks matched or every run timed out, are skipped and returned. If no
+// package has any profiles, the suite's profile is not written.
+func (bs *benchSuite) mergeProfiles(tests []string, profType string) ([]string, error) {
+	var pkgProfiles, missing []string
+	for _, t := range tests {
+		var profiles []string
+		for _, pattern := range invocationProfilePatterns(filepath.Join(bs.profDir, t), profType) {
+			matches, err := filepath.Glob(pattern)
+			if err != nil {
+				return nil, err
+			}
+			profiles = append(profiles, matches...)
+		}
+		profiles = nonEmptyFiles(profiles)
+		if len(profiles) == 0 {
+			missing = append(missing, testBinToPkg(t))
+			continue
+		}
+		dst := bs.getPkgProfileFile(t, profType)
+		if err := mergeProfiles(profiles, dst); err != nil {
+			return nil, errors.Wrapf(err, "merging %s profiles for %s", profType, testBinToPkg(t))
+		}
+		pkgProfiles = append(pkgProfiles, dst)
+	}
+	if len(pkgProfiles) == 0 {
+		return missing, nil
+	}
+	return missing, mergeProfiles(pkgProfiles, bs.getProfileFile(profType))
+}
+
+// nonEmptyFiles returns the files that exist and are not empty. Test binaries
+// that are killed, for instance because they timed out, leave behind empty
+// profiles.
+func nonEmptyFiles(files []string) []string {
+	var res []string
+	for _, f := range files {
+		if fi, err := os.Stat(f); err == nil && fi.Size() > 0 {
+			res = append(res, f)
+		}
+	}
+	return res
+}
+
+// hasProfile returns whether the profiles of the specified type were merged
+// into a profile for the whole suite.
+func (bs *benchSuite) hasProfile(profType string) bool {
+	_, err := os.Stat(bs.getProfileFile(profType))
+	return err == nil
+}
+
+// mergeBenchProfiles merges the profiles of each of the specified types
+// collected by each benchmark suite. Profiles that are not in the pprof format
+// are left as is. Packages without profiles are logged once all profiles are
+// merged.
+func mergeBenchProfiles(bss []*benchSuite, tests []string, profTypes []string) error {
+	profTypes = pprofTypes(profTypes)
+	if len(profTypes) == 0 {
+		return nil
+	}
+	fmt.Fprintf(os.Stderr, "\nmerging profiles:")
+	var spinner ui.Spinner
+	spinner.Start(os.Stderr, "")
+	var skipped []string
+	total := len(bss) * len(profTypes)
+	for i, bs := range bss {
+		for j, profType := range profTypes {
+			spinner.Update(fmt.Sprintf(" %s %s=%s",
+				ui.Fraction(i*len(profTypes)+j+1, total), profType, bs.label))
+			missing, err := bs.mergeProfiles(tests, profType)
+			if err != nil {
+				spinner.Stop()
+				return err
+			}
+			if len(missing) > 0 {
+				skipped = append(skipped, fmt.Sprintf("  %s ('%s'), %s: %s",
+					bs.label, bs.ref, profType, strings.Join(missing, ", ")))
+			}
+		}
+	}
+	spinner.Stop()
+	if len(skipped) > 0 {
+		fmt.Fprintf(os.Stderr, "\nno profiles collected for some packages; skipped merging them:\n%s\n",
+			strings.Join(skipped, "\n"))
+	}
+	return nil
+}
+
+// mergeProfiles merges the specified pprof profiles into a single profile,
+// which is written to the destination file.
+func mergeProfiles(profiles []string, dst string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(dst), filepath.Base(dst)+".tmp")
+	if err != nil {
+		return err
+	}
+	defer func() { _ = os.Remove(tmp.Name()) }()
+	args := append([]string{"go", "tool", "pprof", "-proto"}, profiles...)
+	var stderr strings.Builder
+	if err := spawnWith(os.Stdin, tmp, &stderr, args...); err != nil {
+		_ = tmp.Close()
+		return errors.Wrapf(err, "merging profiles: %s", stderr.String())
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), dst)
+}
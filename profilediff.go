@@ -0,0 +1,243 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// profileDiffNodes is the number of functions listed in each section of a
+// differential profile report.
+const profileDiffNodes = 10
+
+// profileDiff is a differential profile between the profiles of the same type
+// collected by a baseline and a compared benchmark suite.
+type profileDiff struct {
+	profType   string
+	base, comp string // labels of the suites
+	file       string // differential profile, for use with 'go tool pprof'
+	pkgs       []pkgProfileDiff
+}
+
+// pkgProfileDiff is the report of the functions with the largest delta
+// between the profiles of a single package, or of a single benchmark if
+// benchmarks were profiled in isolation.
+type pkgProfileDiff struct {
+	pkg       string
+	flat, cum string // output of 'go tool pprof -top'
+}
+
+// diffBenchProfiles computes differential profiles of each of the specified
+// types between the first benchmark suite and each of the others. Profiles
+// that are not in the pprof format, or that were not collected by both
+// suites, are not diffed.
+func diffBenchProfiles(bss []*benchSuite, profTypes []string) ([]*profileDiff, error) {
+	var diffs []*profileDiff
+	for _, profType := range pprofTypes(profTypes) {
+		for _, bs := range bss[1:] {
+			if !bss[0].hasProfile(profType) || !bs.hasProfile(profType) {
+				// No profiles were collected by one of the suites.
+				continue
+			}
+			d, err := diffProfiles(bss[0], bs, profType)
+			if err != nil {
+				return nil, errors.Wrapf(err, "diffing %s profiles of '%s' and '%s'",
+					profType, bss[0].label, bs.label)
+			}
+			diffs = append(diffs, d)
+		}
+	}
+	return diffs, nil
+}
+
+// diffProfiles computes the differential profile of the specified type
+// between the base and the compared benchmark suite. The differential profile
+// is written next to the merged profile of the compared suite as
+// <type>.diff.prof, and a report is generated for each package, or each
+// benchmark profiled in isolation, that was profiled by both suites.
+func diffProfiles(base, comp *benchSuite, profType string) (*profileDiff, error) {
+	d := &profileDiff{
+		profType: profType,
+		base:     base.label,
+		comp:     comp.label,
+		file:     filepath.Join(comp.profDir, profType+".diff.prof"),
+	}
+	if err := pprofTo(d.file, profType, "-proto",
+		"-diff_base", base.getProfileFile(profType), comp.getProfileFile(profType),
+	); err != nil {
+		return nil, err
+	}
+
+	dirs, err := profiledDirs(base, comp, profType)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		baseProf := filepath.Join(base.profDir, dir, profType+".prof")
+		compProf := filepath.Join(comp.profDir, dir, profType+".prof")
+		flat, err := pprofTop(profType, false, baseProf, compProf)
+		if err != nil {
+			return nil, err
+		}
+		cum, err := pprofTop(profType, true, baseProf, compProf)
+		if err != nil {
+			return nil, err
+		}
+		name := testBinToPkg(dir)
+		if t, bench := filepath.Split(dir); t != "" {
+			name = testBinToPkg(filepath.Clean(t)) + " " + bench
+		}
+		d.pkgs = append(d.pkgs, pkgProfileDiff{pkg: name, flat: flat, cum: cum})
+	}
+	return d, nil
+}
+
+// profiledDirs returns the directories, relative to the suites' profile
+// directories, with profiles of the specified type in both benchmark suites.
+// These are the per-benchmark directories of benchmarks profiled in isolation
+// or, for packages without any, the per-package directories.
+func profiledDirs(base, comp *benchSuite, profType string) ([]string, error) {
+	inBoth := func(dir string) bool {
+		for _, bs := range []*benchSuite{base, comp} {
+			if _, err := os.Stat(filepath.Join(bs.profDir, dir, profType+".prof")); err != nil {
+				return false
+			}
+		}
+		return true
+	}
+	subDirs := func(dir string) ([]string, error) {
+		infos, err := ioutil.ReadDir(filepath.Join(base.profDir, dir))
+		if err != nil {
+			return nil, err
+		}
+		var dirs []string
+		for _, info := range infos {
+			if info.IsDir() {
+				dirs = append(dirs, filepath.Join(dir, info.Name()))
+			}
+		}
+		sort.Strings(dirs)
+		return dirs, nil
+	}
+	tests, err := subDirs("")
+	if err != nil {
+		return nil, err
+	}
+	var dirs []string
+	for _, t := range tests {
+		benches, err := subDirs(t)
+		if err != nil {
+			return nil, err
+		}
+		var found bool
+		for _, b := range benches {
+			if inBoth(b) {
+				dirs = append(dirs, b)
+				found = true
+			}
+		}
+		if !found && inBoth(t) {
+			dirs = append(dirs, t)
+		}
+	}
+	return dirs, nil
+}
+
+// pprofTop returns the functions with the largest flat, or cumulative,
+// delta between the two profiles, as reported by 'go tool pprof -top'.
+func pprofTop(profType string, cum bool, baseProf, compProf string) (string, error) {
+	args := []string{"-top", "-nodecount=" + strconv.Itoa(profileDiffNodes)}
+	if cum {
+		args = append(args, "-cum")
+	}
+	args = append(args, "-diff_base", baseProf, compProf)
+	var buf strings.Builder
+	if err := pprof(&buf, profType, args...); err != nil {
+		return "", err
+	}
+	// Strip the profile metadata preceding the table.
+	out := buf.String()
+	if i := strings.Index(out, "      flat  flat%"); i >= 0 {
+		out = out[i:]
+	}
+	return strings.TrimRight(out, "\n"), nil
+}
+
+// pprofTo runs 'go tool pprof' and writes its output to the specified file.
+func pprofTo(dst, profType string, args ...string) error {
+	f, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	if err := pprof(f, profType, args...); err != nil {
+		_ = f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// pprof runs 'go tool pprof' with the specified arguments.
+func pprof(w io.Writer, profType string, args ...string) error {
+	pargs := []string{"go", "tool", "pprof"}
+	if profType == "mem" {
+		// Benchmarks are concerned with allocations, not the heap in use when
+		// the profile is written.
+		pargs = append(pargs, "-sample_index=alloc_space")
+	}
+	pargs = append(pargs, args...)
+	var stderr strings.Builder
+	if err := spawnWith(os.Stdin, w, &stderr, pargs...); err != nil {
+		return errors.Wrapf(err, "running pprof: %s", stderr.String())
+	}
+	return nil
+}
+
+// formatProfileDiffsText writes the differential profile reports in a
+// textual format.
+func formatProfileDiffsText(w io.Writer, diffs []*profileDiff) {
+	for _, d := range diffs {
+		fmt.Fprintf(w, "\n%s profile diff (%s -> %s), written to %s\n", d.profType, d.base, d.comp, d.file)
+		for _, p := range d.pkgs {
+			fmt.Fprintf(w, "\n%s: top %d by flat delta\n%s\n", p.pkg, profileDiffNodes, p.flat)
+			fmt.Fprintf(w, "\n%s: top %d by cumulative delta\n%s\n", p.pkg, profileDiffNodes, p.cum)
+		}
+	}
+}
+
+var profileDiffsHTML = template.Must(template.New("").Parse(`{{range .}}
+<h2>{{.ProfType}} profile diff ({{.Base}} &rarr; {{.Comp}})</h2>
+<p>Written to <code>{{.File}}</code></p>
+{{range .Pkgs}}<h3>{{.Pkg}}</h3>
+<h4>Top {{.Nodes}} by flat delta</h4>
+<pre>{{.Flat}}</pre>
+<h4>Top {{.Nodes}} by cumulative delta</h4>
+<pre>{{.Cum}}</pre>
+{{end}}{{end}}`))
+
+// formatProfileDiffsHTML writes the differential profile reports as HTML.
+func formatProfileDiffsHTML(w io.Writer, diffs []*profileDiff) error {
+	type pkg struct {
+		Pkg, Flat, Cum string
+		Nodes          int
+	}
+	type diff struct {
+		ProfType, Base, Comp, File string
+		Pkgs                       []pkg
+	}
+	data := make([]diff, len(diffs))
+	for i, d := range diffs {
+		data[i] = diff{ProfType: d.profType, Base: d.base, Comp: d.comp, File: d.file}
+		for _, p := range d.pkgs {
+			data[i].Pkgs = append(data[i].Pkgs, pkg{p.pkg, p.flat, p.cum, profileDiffNodes})
+		}
+	}
+	return profileDiffsHTML.Execute(w, data)
+}
@@ -0,0 +1,247 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Each run records its progress in a state file next to the artifacts
+// directories of its benchmark suites:
+//
+//   ./benchdiff/run.<time>.json
+//
+// The state file holds the arguments of the run, the resolved refs of the
+// suites, the benchmarks being run, and the number of completed runs of each
+// benchmark in each suite along with the size of each suite's output file at
+// that point. The runs of a benchmark in a suite always complete in order, so
+// the number of completed runs identifies them. A run that was interrupted can
+// then be resumed with --resume=<time>, which truncates any partial output
+// and continues with the runs that had not completed.
+
+// runState is the persisted state of a run.
+type runState struct {
+	Time    string        `json:"time"`
+	Args    []string      `json:"args"`
+	Seed    int64         `json:"seed,omitempty"` // --shuffle seed
+	Suites  []suiteState  `json:"suites"`
+	Targets []targetState `json:"targets"`
+	// Completed holds the number of completed runs of each target, in the
+	// order of Targets, by suite id.
+	Completed map[string][]int `json:"completed"`
+	// Offsets holds the size of each suite's output file after the last
+	// completed run, by suite id.
+	Offsets map[string]int64 `json:"offsets"`
+	// Timeouts holds the runs that timed out, by suite id.
+	Timeouts map[string][]benchTimeout `json:"timeouts,omitempty"`
+	// Quarantined holds the benchmarks that failed persistently, by suite id.
+	Quarantined map[string][]benchFailure `json:"quarantined,omitempty"`
+
+	targetIdx map[benchTarget]int // index of each target in Targets
+}
+
+type suiteState struct {
+	Ref string `json:"ref"`
+	ID  string `json:"id"`
+}
+
+type targetState struct {
+	Test    string `json:"test"`
+	Name    string `json:"name,omitempty"`
+	Pattern string `json:"pattern"`
+}
+
+// runStateFile returns the file that the state of the run at the specified
+// time is written to.
+func runStateFile(t time.Time) string {
+	return filepath.Join("benchdiff", "run."+t.Format(timeFormat)+".json")
+}
+
+// newRunState returns the state of a new run of the specified benchmark
+// suites and targets.
+func newRunState(
+	t time.Time, args []string, seed int64, bss []*benchSuite, targets []benchTarget,
+) *runState {
+	st := &runState{
+		Time:      t.Format(timeFormat),
+		Args:      args,
+		Seed:      seed,
+		Completed: make(map[string][]int, len(bss)),
+		Offsets:   make(map[string]int64, len(bss)),
+	}
+	st.setTargets(targets)
+	for _, bs := range bss {
+		st.Suites = append(st.Suites, suiteState{Ref: bs.ref, ID: bs.id})
+		st.Completed[bs.id] = make([]int, len(targets))
+	}
+	return st
+}
+
+// loadRunState loads the state of the run at the specified time.
+func loadRunState(resume string) (*runState, error) {
+	t, err := time.Parse(timeFormat, resume)
+	if err != nil {
+		return nil, err
+	}
+	b, err := ioutil.ReadFile(runStateFile(t))
+	if err != nil {
+		return nil, errors.Wrap(err, "reading run state")
+	}
+	var st runState
+	if err := json.Unmarshal(b, &st); err != nil {
+		return nil, errors.Wrap(err, "reading run state")
+	}
+	st.indexTargets()
+	for _, s := range st.Suites {
+		if len(st.Completed[s.ID]) != len(st.Targets) {
+			return nil, errors.Errorf("run state of '%s' is inconsistent", s.Ref)
+		}
+	}
+	return &st, nil
+}
+
+// time returns the time of the run, which names its artifact files.
+func (st *runState) time() time.Time {
+	t, _ := time.Parse(timeFormat, st.Time)
+	return t
+}
+
+// resumeRefs returns the refs that the run was started with, after checking
+// that the refs parsed from its arguments still resolve to the same commits.
+// Results of different commits must not be mixed, so if a symbolic ref, like
+// a branch or HEAD, has moved since, the run cannot be resumed.
+func (st *runState) resumeRefs(refs []string) ([]string, error) {
+	if len(refs) != len(st.Suites) {
+		return nil, errors.Errorf("run state has %d refs, found %d", len(st.Suites), len(refs))
+	}
+	res := make([]string, len(st.Suites))
+	for i, s := range st.Suites {
+		if s.Ref == worktreeRef {
+			return nil, errors.Errorf("cannot resume a run of %s", worktreeRef)
+		}
+		if refs[i] != s.Ref {
+			saved, err := getRefAsSHA(s.Ref)
+			if err != nil {
+				return nil, err
+			}
+			cur, err := getRefAsSHA(refs[i])
+			if err != nil {
+				return nil, err
+			}
+			if saved != cur {
+				return nil, errors.Errorf("the run was started at '%s', but its ref now resolves to '%s'; "+
+					"cannot resume", s.Ref, refs[i])
+			}
+		}
+		res[i] = s.Ref
+	}
+	return res, nil
+}
+
+func (st *runState) setTargets(targets []benchTarget) {
+	st.Targets = make([]targetState, len(targets))
+	for i, t := range targets {
+		st.Targets[i] = targetState{Test: t.test, Name: t.name, Pattern: t.pattern}
+	}
+	st.indexTargets()
+}
+
+// indexTargets indexes the targets of the run, for looking up their number
+// of completed runs.
+func (st *runState) indexTargets() {
+	st.targetIdx = make(map[benchTarget]int, len(st.Targets))
+	for i, t := range st.targets() {
+		st.targetIdx[t] = i
+	}
+}
+
+// targets returns the benchmark targets of the run.
+func (st *runState) targets() []benchTarget {
+	targets := make([]benchTarget, len(st.Targets))
+	for i, t := range st.Targets {
+		targets[i] = benchTarget{test: t.Test, name: t.Name, pattern: t.Pattern}
+	}
+	return targets
+}
+
+// restoreOutput truncates each suite's output file to its size after the last
+// completed run, discarding the output of any interrupted run, and positions
+// it for appending. The runs that timed out and the quarantined benchmarks are
+// restored as well.
+func (st *runState) restoreOutput(bss []*benchSuite) error {
+	for _, bs := range bss {
+		bs.timeouts = st.Timeouts[bs.id]
+		bs.quarantined = st.Quarantined[bs.id]
+		off := st.Offsets[bs.id]
+		if err := bs.outFile.Truncate(off); err != nil {
+			return err
+		}
+		if _, err := bs.outFile.Seek(off, io.SeekStart); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// done returns whether the iter'th run of the target in the suite completed.
+// A nil runState has no completed runs.
+func (st *runState) done(bs *benchSuite, t benchTarget, iter int) bool {
+	if st == nil {
+		return false
+	}
+	i, ok := st.targetIdx[t]
+	return ok && iter < st.Completed[bs.id][i]
+}
+
+// record records the completion of the iter'th run of the target in the
+// suite, and persists the state. Recording on a nil runState is a no-op.
+func (st *runState) record(bs *benchSuite, t benchTarget, iter int) error {
+	if st == nil {
+		return nil
+	}
+	st.Completed[bs.id][st.targetIdx[t]] = iter + 1
+	off, err := bs.outFile.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	st.Offsets[bs.id] = off
+	if len(bs.timeouts) > 0 {
+		if st.Timeouts == nil {
+			st.Timeouts = make(map[string][]benchTimeout)
+		}
+		st.Timeouts[bs.id] = bs.timeouts
+	}
+	if len(bs.quarantined) > 0 {
+		if st.Quarantined == nil {
+			st.Quarantined = make(map[string][]benchFailure)
+		}
+		st.Quarantined[bs.id] = bs.quarantined
+	}
+	return st.save()
+}
+
+// save atomically writes the state to its file.
+func (st *runState) save() error {
+	b, err := json.MarshalIndent(st, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(runStateFile(st.time()), b)
+}
+
+// logResume logs the progress of a resumed run.
+func (st *runState) logResume() {
+	var n int
+	for _, counts := range st.Completed {
+		for _, c := range counts {
+			n += c
+		}
+	}
+	fmt.Fprintf(os.Stderr, "\nresuming run %s; %d benchmark runs already completed\n", st.Time, n)
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// Values of the --interleave flag.
+const (
+	// interleavePkg alternates between the benchmark suites after running all
+	// benchmarks in a test binary.
+	interleavePkg = "pkg"
+	// interleaveBench alternates between the benchmark suites after running
+	// each benchmark.
+	interleaveBench = "bench"
+)
+
+// parseShuffle parses the --shuffle flag, which is off, on, or the seed used
+// to randomize the order of benchmark runs. It returns a nil rand.Rand if
+// shuffling is off. When on, the chosen seed is logged so that the order can
+// be reproduced.
+func parseShuffle(shuffle string) (*rand.Rand, int64, error) {
+	var seed int64
+	switch shuffle {
+	case "off":
+		return nil, 0, nil
+	case "on":
+		seed = time.Now().UnixNano()
+	default:
+		var err error
+		if seed, err = strconv.ParseInt(shuffle, 10, 64); err != nil {
+			return nil, 0, errors.Errorf("--shuffle must be off, on, or an integer seed, found %q", shuffle)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "shuffling benchmark order with --shuffle=%d\n", seed)
+	return rand.New(rand.NewSource(seed)), seed, nil
+}
+
+// benchTarget is a set of benchmarks in a test binary that are run together:
+// either all benchmarks in the test binary matching the --run pattern, or a
+// single benchmark.
+type benchTarget struct {
+	test    string // test binary
+	name    string // benchmark name, e.g. BenchmarkFoo/bar; empty for all
+	pattern string // -test.bench pattern that selects the benchmarks
+}
+
+// pkgTargets returns a target for all benchmarks matching runPattern in each
+// of the test binaries.
+func pkgTargets(tests []string, runPattern string) []benchTarget {
+	targets := make([]benchTarget, len(tests))
+	for i, t := range tests {
+		targets[i] = benchTarget{test: t, pattern: runPattern}
+	}
+	return targets
+}
+
+// dir returns the name of the directory that the benchmark's profiles are
+// written to within its package's profile directory.
+func (t benchTarget) dir() string {
+	return strings.ReplaceAll(t.name, "/", "_")
+}
+
+func (t benchTarget) String() string {
+	if t.name == "" {
+		return testBinToPkg(t.test)
+	}
+	return testBinToPkg(t.test) + " " + t.name
+}
+
+// listBenchmarks returns the top-level benchmarks in the test binary of the
+// suite that match the first element of runPattern, using -test.list.
+func (bs *benchSuite) listBenchmarks(test, runPattern string) ([]string, error) {
+	top := strings.SplitN(runPattern, "/", 2)[0]
+	out, err := capture(bs.getTestBinary(test), "-test.list", top)
+	if err != nil {
+		return nil, errors.Wrapf(err, "listing benchmarks in %s", testBinToPkg(test))
+	}
+	var benches []string
+	for _, line := range strings.Split(out, "\n") {
+		if strings.HasPrefix(line, "Benchmark") {
+			benches = append(benches, line)
+		}
+	}
+	return benches, nil
+}
+
+// listCommonBenchmarks returns the benchmarks in each of the test binaries
+// that match runPattern and are present in all benchmark suites.
+func listCommonBenchmarks(
+	bss []*benchSuite, tests []string, runPattern string,
+) (map[string][]string, error) {
+	res := make(map[string][]string, len(tests))
+	for _, t := range tests {
+		counts := make(map[string]int)
+		for _, bs := range bss {
+			benches, err := bs.listBenchmarks(t, runPattern)
+			if err != nil {
+				return nil, err
+			}
+			for _, b := range benches {
+				counts[b]++
+			}
+		}
+		for b, c := range counts {
+			if c == len(bss) {
+				res[t] = append(res[t], b)
+			}
+		}
+		sort.Strings(res[t])
+	}
+	return res, nil
+}
+
+// listBenchTargets returns a target for each benchmark matching runPattern in
+// the test binaries of all benchmark suites. Sub-benchmarks are selected by
+// the remainder of runPattern, so they are profiled together with their
+// top-level benchmark.
+func listBenchTargets(
+	bss []*benchSuite, tests []string, runPattern string,
+) ([]benchTarget, error) {
+	benches, err := listCommonBenchmarks(bss, tests, runPattern)
+	if err != nil {
+		return nil, err
+	}
+	var sub string
+	if i := strings.Index(runPattern, "/"); i >= 0 {
+		sub = runPattern[i:]
+	}
+	var targets []benchTarget
+	for _, t := range tests {
+		for _, b := range benches[t] {
+			targets = append(targets, benchTarget{
+				test:    t,
+				name:    b,
+				pattern: "^" + regexp.QuoteMeta(b) + "$" + sub,
+			})
+		}
+	}
+	return targets, nil
+}
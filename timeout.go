@@ -0,0 +1,304 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// timeoutOpts configures when test binaries are considered hung and killed.
+type timeoutOpts struct {
+	// run limits the duration of each invocation of a test binary.
+	run time.Duration
+	// bench limits the duration of each benchmark. Test binaries print the
+	// name of each benchmark once its first iteration returns and its result
+	// when it finishes, so a benchmark is considered hung when the binary
+	// produces no output for this long.
+	bench time.Duration
+}
+
+// benchTimeout records a run of a test binary that was killed because it
+// exceeded a timeout.
+type benchTimeout struct {
+	Test string `json:"test"`
+	// Benchmark is the full name of the benchmark that was running when the
+	// test binary was killed, without the GOMAXPROCS suffix, or empty if it
+	// could not be determined.
+	Benchmark string        `json:"benchmark,omitempty"`
+	Iter      int           `json:"iter"`
+	Limit     time.Duration `json:"limit"`
+	PerBench  bool          `json:"per_bench,omitempty"` // whether Limit is --bench-timeout
+}
+
+// topLevel returns the name of the top-level benchmark that timed out.
+func (t benchTimeout) topLevel() string {
+	if i := strings.IndexByte(t.Benchmark, '/'); i >= 0 {
+		return t.Benchmark[:i]
+	}
+	return t.Benchmark
+}
+
+// String implements fmt.Stringer.
+func (t benchTimeout) String() string {
+	name := t.Benchmark
+	if name == "" {
+		name = "(unknown benchmark)"
+	}
+	limit := "--timeout"
+	if t.PerBench {
+		limit = "--bench-timeout"
+	}
+	return fmt.Sprintf("%s %s iter=%d: exceeded %s=%s", testBinToPkg(t.Test), name, t.Iter+1, limit, t.Limit)
+}
+
+// timeoutError is returned by runTestBinary when it killed a test binary for
+// exceeding a timeout.
+type timeoutError struct {
+	benchmark string // see benchTimeout.Benchmark
+	// completed is the full name of the last benchmark that completed before
+	// the test binary was killed, if any. See hungBenchmark.
+	completed string
+	limit     time.Duration
+	perBench  bool
+}
+
+func (e *timeoutError) Error() string {
+	return fmt.Sprintf("timed out after %s", e.limit)
+}
+
+// hangWatchdog is an io.Writer that forwards the output of a test binary and
+// cancels its context if no output is written for the specified duration. It
+// tracks the last, incomplete line of output, which names the benchmark that
+// is running.
+type hangWatchdog struct {
+	w     io.Writer
+	limit time.Duration
+	timer *time.Timer // nil without a limit
+	line  []byte
+}
+
+func newHangWatchdog(w io.Writer, limit time.Duration, cancel context.CancelFunc) *hangWatchdog {
+	wd := &hangWatchdog{w: w, limit: limit}
+	if limit > 0 {
+		wd.timer = time.AfterFunc(limit, cancel)
+	}
+	return wd
+}
+
+// Write implements io.Writer.
+func (wd *hangWatchdog) Write(b []byte) (int, error) {
+	if wd.timer != nil {
+		wd.timer.Reset(wd.limit)
+	}
+	if i := bytes.LastIndexByte(b, '\n'); i >= 0 {
+		wd.line = append(wd.line[:0], b[i+1:]...)
+	} else {
+		wd.line = append(wd.line, b...)
+	}
+	return wd.w.Write(b)
+}
+
+// stop stops the watchdog. It must be called once the test binary exited.
+func (wd *hangWatchdog) stop() {
+	if wd.timer != nil {
+		wd.timer.Stop()
+	}
+}
+
+// runningBenchmark returns the full name of the benchmark that was running
+// when the output stopped, without the suffix of the specified GOMAXPROCS
+// value, if any.
+func (wd *hangWatchdog) runningBenchmark(procs int) string {
+	f := strings.Fields(string(wd.line))
+	if len(f) == 0 || !strings.HasPrefix(f[0], "Benchmark") {
+		return ""
+	}
+	return trimProcs(f[0], procs)
+}
+
+// lastCompletedBenchmark returns the full name of the last benchmark that
+// reported a result or failed in the output of a test binary, without the
+// suffix of the specified GOMAXPROCS value, or an empty string if none did.
+func lastCompletedBenchmark(output []byte, procs int) string {
+	var last string
+	s := bufio.NewScanner(bytes.NewReader(output))
+	for s.Scan() {
+		line := s.Text()
+		if i := strings.Index(line, failureMarker); i >= 0 {
+			if f := strings.Fields(line[i+len(failureMarker):]); len(f) > 0 {
+				last = f[0]
+			}
+			continue
+		}
+		// Results list the name, the number of iterations, and the metrics.
+		f := strings.Fields(line)
+		if len(f) < 3 || !strings.HasPrefix(f[0], "Benchmark") {
+			continue
+		}
+		if _, err := strconv.Atoi(f[1]); err == nil {
+			last = trimProcs(f[0], procs)
+		}
+	}
+	return last
+}
+
+// hungBenchmark determines the top-level benchmark that hung in a run of a
+// target covering several benchmarks that timed out, along with the
+// benchmarks that were to run after it and did not get to.
+//
+// Test binaries only print the name of a benchmark once its first iteration
+// returns, so a benchmark that hangs in its first iteration produces no output
+// at all. Benchmarks run in the order that -test.list lists them, so the hung
+// benchmark is then either the last benchmark that completed, if that was one
+// of its sub-benchmarks, or one of those after it. Each candidate is run
+// again, alone and for a single iteration, and the first one that times out
+// is the hung benchmark. If none does, an empty name is returned.
+func (bs *benchSuite) hungBenchmark(
+	ctx context.Context, target benchTarget, tErr *timeoutError,
+) (string, []string, error) {
+	listed, err := bs.listBenchmarks(target.test, target.pattern)
+	if err != nil {
+		return "", nil, err
+	}
+	// Benchmarks that timed out before were skipped.
+	var benches []string
+	skipped := bs.timedOut(target.test)
+	for _, b := range listed {
+		if i := sort.SearchStrings(skipped, b); i == len(skipped) || skipped[i] != b {
+			benches = append(benches, b)
+		}
+	}
+	index := func(name string) int {
+		top := strings.SplitN(name, "/", 2)[0]
+		for i, b := range benches {
+			if b == top {
+				return i
+			}
+		}
+		return -1
+	}
+	if tErr.benchmark != "" {
+		if i := index(tErr.benchmark); i >= 0 {
+			return tErr.benchmark, benches[i+1:], nil
+		}
+		return tErr.benchmark, nil, nil
+	}
+
+	start := 0
+	if i := index(tErr.completed); i >= 0 {
+		start = i
+		if !strings.Contains(tErr.completed, "/") {
+			// It finished, along with any sub-benchmarks.
+			start++
+		}
+	}
+	var sub string
+	if i := strings.Index(target.pattern, "/"); i >= 0 {
+		sub = target.pattern[i:]
+	}
+	noProfile := func(string) string { return "" }
+	fmt.Fprintf(os.Stderr, "  looking for the benchmark that hung in %s\n", testBinToPkg(target.test))
+	for i := start; i < len(benches); i++ {
+		pattern := "^" + regexp.QuoteMeta(benches[i]) + "$" + sub
+		err := runTestBinary(ctx, bs, target.test, pattern, "1x", profileOpts{}, noProfile, ioutil.Discard)
+		switch err.(type) {
+		case nil, *failureError:
+			// It completed, so it did not hang.
+		case *timeoutError:
+			fmt.Fprintf(os.Stderr, "  %s hung\n", benches[i])
+			return benches[i], benches[i+1:], nil
+		default:
+			return "", nil, err
+		}
+	}
+	return "", nil, nil
+}
+
+// remainingTarget returns a target for the specified top-level benchmarks of
+// a target covering several benchmarks, which did not get to run because an
+// earlier benchmark hung.
+func remainingTarget(target benchTarget, benches []string) benchTarget {
+	quoted := make([]string, len(benches))
+	for i, b := range benches {
+		quoted[i] = regexp.QuoteMeta(b)
+	}
+	pattern := "^(" + strings.Join(quoted, "|") + ")$"
+	if i := strings.Index(target.pattern, "/"); i >= 0 {
+		pattern += target.pattern[i:]
+	}
+	return benchTarget{test: target.test, pattern: pattern}
+}
+
+// recordTimeout records that the iter'th run of the target in the suite timed
+// out.
+func (bs *benchSuite) recordTimeout(target benchTarget, iter int, err *timeoutError) {
+	bs.timeouts = append(bs.timeouts, benchTimeout{
+		Test:      target.test,
+		Benchmark: err.benchmark,
+		Iter:      iter,
+		Limit:     err.limit,
+		PerBench:  err.perBench,
+	})
+}
+
+// timedOut returns the top-level benchmarks in the test binary that timed out
+// in an earlier run of the suite. Timeouts of unknown benchmarks are omitted.
+func (bs *benchSuite) timedOut(test string) []string {
+	var names []string
+	seen := make(map[string]struct{})
+	for _, t := range bs.timeouts {
+		if t.Test != test || t.Benchmark == "" {
+			continue
+		}
+		name := t.topLevel()
+		if _, ok := seen[name]; !ok {
+			seen[name] = struct{}{}
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// skipTimedOut returns whether the targeted benchmark should not be run again
+// in the suite because it timed out before. Targets covering all benchmarks in
+// a test binary are still run, skipping the benchmarks that timed out.
+func (bs *benchSuite) skipTimedOut(target benchTarget) bool {
+	for _, name := range bs.timedOut(target.test) {
+		if name == target.name {
+			return true
+		}
+	}
+	return false
+}
+
+// logTimeouts logs the runs of each suite that timed out, separately from the
+// results.
+func logTimeouts(bss []*benchSuite) {
+	var n int
+	for _, bs := range bss {
+		n += len(bs.timeouts)
+	}
+	if n == 0 {
+		return
+	}
+	fmt.Fprintf(os.Stderr, "\n%d run(s) timed out:\n", n)
+	for _, bs := range bss {
+		if len(bs.timeouts) == 0 {
+			continue
+		}
+		fmt.Fprintf(os.Stderr, "  %s ('%s'):\n", bs.label, bs.ref)
+		for _, t := range bs.timeouts {
+			fmt.Fprintf(os.Stderr, "    %s\n", t)
+		}
+	}
+}